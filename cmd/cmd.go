@@ -18,9 +18,14 @@
 package cmd
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/minio/cli"
 	"github.com/minio/mc/pkg/console"
 	minfs "github.com/minio/minfs/fs"
@@ -48,6 +53,109 @@ var globalFlags = []cli.Flag{
 	},
 }
 
+// Management commands talking to a running minfs instance.
+var minfsCommands = []cli.Command{
+	{
+		Name:   "status",
+		Usage:  "Show the status of a mounted minfs.",
+		Action: mainStatus,
+	},
+	{
+		Name:   "umount",
+		Usage:  "Flush pending uploads and unmount a mounted minfs.",
+		Action: mainUmount,
+	},
+	{
+		Name:   "share",
+		Usage:  "Print a presigned url of a file in a mounted minfs.",
+		Action: mainShare,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "expires",
+				Usage: "Validity of the url, the share_expiry of the mount if not set.",
+			},
+		},
+	},
+	{
+		Name:   "throttle",
+		Usage:  "Change the bandwidth limits of a mounted minfs.",
+		Action: mainThrottle,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "upload",
+				Usage: "Maximum upload rate in bytes per second, e.g. 10M, 0 for unlimited.",
+			},
+			cli.StringFlag{
+				Name:  "download",
+				Usage: "Maximum download rate in bytes per second, e.g. 10M, 0 for unlimited.",
+			},
+		},
+	},
+}
+
+// NeedsDaemon returns false if args invoke a management command, which
+// runs in the foreground.
+func NeedsDaemon(args []string) bool {
+	if len(args) < 2 {
+		return true
+	}
+	for _, command := range minfsCommands {
+		if command.Name == args[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix
+// of binary multiples, e.g. 512M.
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		case "T":
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size << shift, nil
+}
+
+// parseTimeOfDay parses a time of day as hhmm, e.g. 0830, into the
+// duration since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("1504", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// readKeyFile reads a 32 byte key, either raw or base64 encoded.
+func readKeyFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
 // Help template for minfs.
 var minfsHelpTemplate = `NAME:
   {{.Name}} - {{.Usage}}
@@ -101,6 +209,7 @@ func Main() {
 	app.Usage = "Fuse driver for Cloud Storage Server."
 	app.Description = `MinFS is a fuse driver for Amazon S3 compatible object storage server. Use it to store photos, videos, VMs, containers, log files, or any blob of data as objects on your object storage server.`
 	app.Flags = append(minfsFlags, globalFlags...)
+	app.Commands = minfsCommands
 	app.CustomAppHelpTemplate = minfsHelpTemplate
 	app.Before = func(c *cli.Context) error {
 		_, err := minfs.InitMinFSConfig()
@@ -133,16 +242,317 @@ func Main() {
 				} else {
 					opts = append(opts, minfs.SetGID(uint32(val)))
 				}
+			case "union":
+				if len(vals) == 1 {
+					console.Fatalln("Union has no value")
+				} else if union, err := minfs.LoadUnionConfig(vals[1]); err != nil {
+					console.Fatalf("Union is not a valid value: %s: %s\n", vals[1], err)
+				} else {
+					opts = append(opts, minfs.Union(union))
+				}
 			case "cache":
 				if len(vals) == 1 {
 					console.Fatalln("Cache has no value")
 				} else {
 					opts = append(opts, minfs.CacheDir(vals[1]))
 				}
+			case "max_upload_rate":
+				if len(vals) == 1 {
+					console.Fatalln("Max upload rate has no value")
+				} else if val, err := parseSize(vals[1]); err != nil {
+					console.Fatalf("Max upload rate is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.MaxUploadRate(val))
+				}
+			case "max_download_rate":
+				if len(vals) == 1 {
+					console.Fatalln("Max download rate has no value")
+				} else if val, err := parseSize(vals[1]); err != nil {
+					console.Fatalf("Max download rate is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.MaxDownloadRate(val))
+				}
+			case "rate_schedule":
+				// rate_schedule=<hhmm>-<hhmm>:<upload>:<download>
+				if len(vals) == 1 {
+					console.Fatalln("Rate schedule has no value")
+				} else if parts := strings.Split(vals[1], ":"); len(parts) != 3 {
+					console.Fatalf("Rate schedule is not a valid value: %s\n", vals[1])
+				} else if times := strings.Split(parts[0], "-"); len(times) != 2 {
+					console.Fatalf("Rate schedule times are not a valid value: %s\n", parts[0])
+				} else if from, err := parseTimeOfDay(times[0]); err != nil {
+					console.Fatalf("Rate schedule start is not a valid value: %s\n", times[0])
+				} else if to, err := parseTimeOfDay(times[1]); err != nil {
+					console.Fatalf("Rate schedule end is not a valid value: %s\n", times[1])
+				} else if upload, err := parseSize(parts[1]); err != nil {
+					console.Fatalf("Rate schedule upload is not a valid value: %s\n", parts[1])
+				} else if download, err := parseSize(parts[2]); err != nil {
+					console.Fatalf("Rate schedule download is not a valid value: %s\n", parts[2])
+				} else {
+					opts = append(opts, minfs.RateSchedule(from, to, upload, download))
+				}
+			case "metrics":
+				if len(vals) == 1 {
+					console.Fatalln("Metrics has no value")
+				} else {
+					opts = append(opts, minfs.Metrics(vals[1]))
+				}
+			case "retries":
+				// retries=<count>[:<backoff>]
+				if len(vals) == 1 {
+					console.Fatalln("Retries has no value")
+				} else if parts := strings.Split(vals[1], ":"); len(parts) > 2 {
+					console.Fatalf("Retries is not a valid value: %s\n", vals[1])
+				} else if retries, err := strconv.Atoi(parts[0]); err != nil {
+					console.Fatalf("Retries count is not a valid value: %s\n", parts[0])
+				} else if len(parts) == 1 {
+					opts = append(opts, minfs.Retries(retries, time.Second))
+				} else if backoff, err := time.ParseDuration(parts[1]); err != nil {
+					console.Fatalf("Retries backoff is not a valid value: %s\n", parts[1])
+				} else {
+					opts = append(opts, minfs.Retries(retries, backoff))
+				}
+			case "readahead":
+				if len(vals) == 1 {
+					console.Fatalln("Read-ahead has no value")
+				} else if val, err := parseSize(vals[1]); err != nil {
+					console.Fatalf("Read-ahead is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.ReadAhead(val))
+				}
+			case "readahead_workers":
+				if len(vals) == 1 {
+					console.Fatalln("Read-ahead workers has no value")
+				} else if val, err := strconv.Atoi(vals[1]); err != nil {
+					console.Fatalf("Read-ahead workers is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.ReadAheadWorkers(val))
+				}
+			case "rename_workers":
+				if len(vals) == 1 {
+					console.Fatalln("Rename workers has no value")
+				} else if val, err := strconv.Atoi(vals[1]); err != nil {
+					console.Fatalf("Rename workers is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.RenameWorkers(val))
+				}
+			case "share_expiry":
+				if len(vals) == 1 {
+					console.Fatalln("Share expiry has no value")
+				} else if val, err := time.ParseDuration(vals[1]); err != nil {
+					console.Fatalf("Share expiry is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.ShareExpiry(val))
+				}
+			case "shutdown_timeout":
+				if len(vals) == 1 {
+					console.Fatalln("Shutdown timeout has no value")
+				} else if val, err := time.ParseDuration(vals[1]); err != nil {
+					console.Fatalf("Shutdown timeout is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.ShutdownTimeout(val))
+				}
+			case "recover":
+				if len(vals) == 1 {
+					console.Fatalln("Recover has no value")
+				} else {
+					opts = append(opts, minfs.RecoverPolicy(vals[1]))
+				}
+			case "offline":
+				if len(vals) == 1 {
+					opts = append(opts, minfs.Offline(30*time.Second))
+				} else if val, err := time.ParseDuration(vals[1]); err != nil {
+					console.Fatalf("Offline probe interval is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.Offline(val))
+				}
+			case "sse":
+				// sse=s3, sse=kms[:<key id>] or sse=c:<key file>
+				if len(vals) == 1 {
+					console.Fatalln("Sse has no value")
+				}
+				parts := strings.SplitN(vals[1], ":", 2)
+				switch {
+				case parts[0] == minfs.SSES3 && len(parts) == 1:
+					opts = append(opts, minfs.SSE(minfs.SSES3, "", nil))
+				case parts[0] == minfs.SSEKMS && len(parts) == 1:
+					opts = append(opts, minfs.SSE(minfs.SSEKMS, "", nil))
+				case parts[0] == minfs.SSEKMS:
+					opts = append(opts, minfs.SSE(minfs.SSEKMS, parts[1], nil))
+				case parts[0] == minfs.SSEC && len(parts) == 2:
+					key, err := readKeyFile(parts[1])
+					if err != nil {
+						console.Fatalf("Unable to read encryption key %s: %s\n", parts[1], err)
+					}
+					opts = append(opts, minfs.SSE(minfs.SSEC, "", key))
+				default:
+					console.Fatalf("Sse is not a valid value: %s\n", vals[1])
+				}
+			case "asof":
+				if len(vals) == 1 {
+					console.Fatalln("Asof has no value")
+				} else if val, err := time.Parse(time.RFC3339, vals[1]); err != nil {
+					console.Fatalf("Asof is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.AsOf(val))
+				}
+			case "mime_sniff":
+				opts = append(opts, minfs.MimeSniff())
+			case "mime_magic":
+				// mime_magic=<offset>:<hex bytes>:<type>
+				if len(vals) == 1 {
+					console.Fatalln("Mime magic has no value")
+				}
+				parts := strings.SplitN(vals[1], ":", 3)
+				if len(parts) != 3 {
+					console.Fatalf("Mime magic is not a valid value: %s\n", vals[1])
+				}
+				offset, err := strconv.Atoi(parts[0])
+				if err != nil || offset < 0 {
+					console.Fatalf("Mime magic is not a valid value: %s\n", vals[1])
+				}
+				magicBytes, err := hex.DecodeString(parts[1])
+				if err != nil || len(magicBytes) == 0 {
+					console.Fatalf("Mime magic is not a valid value: %s\n", vals[1])
+				}
+				opts = append(opts, minfs.MimeMagic(offset, magicBytes, parts[2]))
+			case "mime_type":
+				// mime_type=<pattern>:<type>
+				if len(vals) == 1 {
+					console.Fatalln("Mime type has no value")
+				} else if i := strings.LastIndex(vals[1], ":"); i > 0 {
+					opts = append(opts, minfs.MimeType(vals[1][:i], vals[1][i+1:]))
+				} else {
+					console.Fatalf("Mime type is not a valid value: %s\n", vals[1])
+				}
+			case "versions":
+				opts = append(opts, minfs.Versions())
+			case "storage_class":
+				// storage_class=<class> or storage_class=<pattern>:<class>
+				if len(vals) == 1 {
+					console.Fatalln("Storage class has no value")
+				} else if i := strings.LastIndex(vals[1], ":"); i > 0 {
+					opts = append(opts, minfs.StorageRule(vals[1][:i], vals[1][i+1:]))
+				} else {
+					opts = append(opts, minfs.StorageClass(vals[1]))
+				}
+			case "restore":
+				if len(vals) == 1 {
+					opts = append(opts, minfs.Restore(1))
+				} else if val, err := strconv.Atoi(vals[1]); err != nil || val < 1 {
+					console.Fatalf("Restore is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.Restore(val))
+				}
+			case "encrypt_key":
+				// encrypt_key=<key file>, with a 32 byte key, raw or base64
+				if len(vals) == 1 {
+					console.Fatalln("Encrypt key has no value")
+				} else if key, err := readKeyFile(vals[1]); err != nil {
+					console.Fatalf("Unable to read encryption key %s: %s\n", vals[1], err)
+				} else {
+					opts = append(opts, minfs.Encrypt(key))
+				}
+			case "encrypt_passphrase":
+				// encrypt_passphrase=<passphrase file>
+				if len(vals) == 1 {
+					console.Fatalln("Encrypt passphrase has no value")
+				} else if passphrase, err := ioutil.ReadFile(vals[1]); err != nil {
+					console.Fatalf("Unable to read encryption passphrase %s: %s\n", vals[1], err)
+				} else {
+					opts = append(opts, minfs.EncryptPassphrase(passphrase))
+				}
+			case "encrypt_names":
+				opts = append(opts, minfs.EncryptNames())
+			case "cache_size":
+				if len(vals) == 1 {
+					console.Fatalln("Cache size has no value")
+				} else if val, err := parseSize(vals[1]); err != nil {
+					console.Fatalf("Cache size is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.CacheSize(val))
+				}
+			case "cache_min_free":
+				if len(vals) == 1 {
+					console.Fatalln("Cache min free has no value")
+				} else if val, err := parseSize(vals[1]); err != nil {
+					console.Fatalf("Cache min free is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.CacheMinFree(val))
+				}
+			case "leases":
+				if len(vals) == 1 {
+					opts = append(opts, minfs.Leases(30*time.Second))
+				} else if val, err := time.ParseDuration(vals[1]); err != nil {
+					console.Fatalf("Lease ttl is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.Leases(val))
+				}
 			case "insecure":
 				opts = append(opts, minfs.Insecure())
+			case "cacert":
+				if len(vals) == 1 {
+					console.Fatalln("CA cert has no value")
+				} else {
+					opts = append(opts, minfs.CACert(vals[1]))
+				}
+			case "cert":
+				if len(vals) == 1 {
+					console.Fatalln("Cert has no value")
+				} else {
+					opts = append(opts, minfs.ClientCert(vals[1]))
+				}
+			case "key":
+				if len(vals) == 1 {
+					console.Fatalln("Key has no value")
+				} else {
+					opts = append(opts, minfs.ClientKey(vals[1]))
+				}
+			case "tls_min_version":
+				if len(vals) == 1 {
+					console.Fatalln("TLS min version has no value")
+				} else {
+					opts = append(opts, minfs.TLSMinVersion(vals[1]))
+				}
 			case "debug":
-				opts = append(opts, minfs.Debug())
+				if len(vals) == 1 {
+					opts = append(opts, minfs.Debug())
+				} else {
+					opts = append(opts, minfs.Debug(strings.Split(vals[1], ":")...))
+				}
+			case "log_file":
+				if len(vals) == 1 {
+					console.Fatalln("Log file has no value")
+				} else {
+					opts = append(opts, minfs.LogFile(vals[1]))
+				}
+			case "log_format":
+				if len(vals) == 1 {
+					console.Fatalln("Log format has no value")
+				} else {
+					opts = append(opts, minfs.LogFormat(vals[1]))
+				}
+			case "log_level":
+				if len(vals) == 1 {
+					console.Fatalln("Log level has no value")
+				} else if val, err := logrus.ParseLevel(vals[1]); err != nil {
+					console.Fatalf("Log level is not a valid value: %s\n", vals[1])
+				} else {
+					opts = append(opts, minfs.LogLevel(val))
+				}
+			case "log_rotate":
+				// log_rotate=<size in MiB>:<backups>
+				if len(vals) == 1 {
+					console.Fatalln("Log rotate has no value")
+				} else if parts := strings.Split(vals[1], ":"); len(parts) != 2 {
+					console.Fatalf("Log rotate is not a valid value: %s\n", vals[1])
+				} else if size, err := strconv.ParseInt(parts[0], 10, 64); err != nil {
+					console.Fatalf("Log rotate size is not a valid value: %s\n", parts[0])
+				} else if backups, err := strconv.Atoi(parts[1]); err != nil {
+					console.Fatalf("Log rotate backups is not a valid value: %s\n", parts[1])
+				} else {
+					opts = append(opts, minfs.LogRotate(size<<20, backups))
+				}
 			}
 
 			target := c.Args().Get(0)
@@ -0,0 +1,134 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/minio/cli"
+	"github.com/minio/mc/pkg/console"
+	minfs "github.com/minio/minfs/fs"
+)
+
+// dialControl connects to the instance serving the mountpoint argument.
+func dialControl(c *cli.Context) *minfs.ControlClient {
+	mountpoint := c.Args().First()
+	if mountpoint == "" {
+		cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+	}
+
+	client, err := minfs.DialControl(mountpoint)
+	if err != nil {
+		console.Fatalf("Unable to connect to minfs at %s: %s\n", mountpoint, err)
+	}
+	return client
+}
+
+// mainStatus shows the status of a running instance.
+func mainStatus(c *cli.Context) {
+	client := dialControl(c)
+	defer client.Close()
+
+	status, err := client.Status()
+	if err != nil {
+		console.Fatalln("Unable to retrieve status", err)
+	}
+
+	console.Printf("Mountpoint: %s\n", status.Mountpoint)
+	console.Printf("Endpoint:   %s\n", status.Endpoint)
+	console.Printf("Bucket:     %s\n", status.Bucket)
+	console.Printf("Handles:    %d\n", status.Handles)
+	console.Printf("Queued:     %d\n", status.Queued)
+	console.Printf("Cache size: %d bytes\n", status.CacheSize)
+	console.Printf("Online:     %t\n", status.Online)
+	console.Printf("Upload:     %s\n", formatRate(status.Rates.Upload))
+	console.Printf("Download:   %s\n", formatRate(status.Rates.Download))
+}
+
+// formatRate returns a bandwidth limit in bytes per second for display.
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d bytes/s", rate)
+}
+
+// mainThrottle changes the bandwidth limits of a running instance, and
+// shows the ones in effect.
+func mainThrottle(c *cli.Context) {
+	upload, download := int64(-1), int64(-1)
+	for _, flag := range []struct {
+		name string
+		rate *int64
+	}{{"upload", &upload}, {"download", &download}} {
+		if !c.IsSet(flag.name) {
+			continue
+		}
+		rate, err := parseSize(c.String(flag.name))
+		if err != nil {
+			console.Fatalf("Rate is not a valid value: %s\n", c.String(flag.name))
+		}
+		*flag.rate = rate
+	}
+
+	client := dialControl(c)
+	defer client.Close()
+
+	rates, err := client.Throttle(upload, download)
+	if err != nil {
+		console.Fatalln("Unable to throttle", err)
+	}
+
+	console.Printf("Upload:     %s\n", formatRate(rates.Upload))
+	console.Printf("Download:   %s\n", formatRate(rates.Download))
+}
+
+// mainShare prints a presigned url of the file argument, signed by the
+// instance serving it.
+func mainShare(c *cli.Context) {
+	p := c.Args().First()
+	if p == "" {
+		cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+	}
+
+	mountpoint, rel, err := minfs.FindMountpoint(p)
+	if err != nil {
+		console.Fatalf("Unable to find minfs serving %s: %s\n", p, err)
+	}
+
+	client, err := minfs.DialControl(mountpoint)
+	if err != nil {
+		console.Fatalf("Unable to connect to minfs at %s: %s\n", mountpoint, err)
+	}
+	defer client.Close()
+
+	u, err := client.Share(rel, c.Duration("expires"))
+	if err != nil {
+		console.Fatalln("Unable to share", err)
+	}
+	console.Println(u)
+}
+
+// mainUmount flushes and unmounts a running instance.
+func mainUmount(c *cli.Context) {
+	client := dialControl(c)
+	defer client.Close()
+
+	if err := client.Unmount(); err != nil {
+		console.Fatalln("Unable to unmount", err)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// Objects composed of other objects need all but the last one to be of at
+// least 5 MiB. Appending to smaller files downloads them completely before
+// the append, unless they are cached, and uploads them completely.
+const minAppendSize = 5 * 1024 * 1024
+
+// prefix of the temporary objects holding appended bytes.
+const partPrefix = internalPrefix + "parts/"
+
+// errStale is returned when appending to an object which has been changed
+// meanwhile.
+var errStale = fuse.Errno(syscall.ESTALE)
+
+// appendOnly returns true if req opens f only to append to it, without
+// fetching its content.
+func (f *File) appendOnly(req *fuse.OpenRequest) bool {
+	if req.Flags&fuse.OpenAppend == 0 || req.Flags&fuse.OpenTruncate != 0 || !req.Flags.IsWriteOnly() {
+		return false
+	}
+
+	// encrypted objects can't be composed, and appends can't be
+	// journaled while offline.
+	if f.mfs.encrypted() || f.mfs.config.offline {
+		return false
+	}
+	return f.ETag != "" && f.VersionID == "" && f.Layer == 0 && f.Size >= minAppendSize
+}
+
+// openAppend opens an empty cache file for the bytes appended to f.
+func (f *File) openAppend() (*openFile, error) {
+	cachePath, err := f.mfs.NewCachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	of, err := openCacheFile(f, cachePath, os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+
+	of.base = int64(f.Size)
+	return of, nil
+}
+
+// fetch rewrites the cache file as the complete file, if it holds only
+// appended bytes. Returns true if it has been rewritten, called with baseM
+// held.
+func (of *openFile) fetch() (bool, error) {
+	if of.base == 0 {
+		return false, nil
+	}
+
+	mfs := of.f.mfs
+	if err := mfs.reserveCache(of.base); err != nil {
+		return false, err
+	}
+
+	file, err := of.fetchFile()
+	if err != nil {
+		mfs.releaseCache(of.base)
+		return false, err
+	}
+
+	of.File.Close()
+	of.File = file
+	of.base, of.appended = 0, 0
+	return true, nil
+}
+
+// fetchFile writes the complete file to a new cache file, which replaces
+// the cache file.
+func (of *openFile) fetchFile() (*os.File, error) {
+	mfs := of.f.mfs
+	cachePath, err := mfs.NewCachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mfs.config.mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = of.fetchInto(file); err == nil {
+		// the complete file keeps the path of the cache file
+		err = os.Rename(cachePath, of.cachePath)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(cachePath)
+		return nil, err
+	}
+	return file, nil
+}
+
+// fetchInto writes the bytes of the object before the cache file to file,
+// followed by the cache file.
+func (of *openFile) fetchInto(file *os.File) error {
+	mfs := of.f.mfs
+	remotePath := of.f.RemotePath()
+
+	if err := mfs.s3(context.Background(), "GetObject", remotePath, func() error {
+		// start over after a failed attempt
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+
+		reqHeaders := mfs.requestHeaders()
+		if err := reqHeaders.SetRange(0, of.base-1); err != nil {
+			return err
+		}
+		if err := reqHeaders.SetMatchETag(of.f.ETag); err != nil {
+			return err
+		}
+
+		bucket, key := mfs.splitPath(remotePath)
+		object, _, err := minio.Core{Client: mfs.client(remotePath)}.GetObject(bucket, key, reqHeaders)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		n, err := io.Copy(file, mfs.downloadReader(context.Background(), object))
+		mfs.metrics.downloaded.Add(uint64(n))
+		if err == nil && n != of.base {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fi, err := of.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, io.NewSectionReader(of.File, 0, fi.Size()))
+	return err
+}
+
+// flushAppend appends the bytes of the cache file of size bytes which
+// haven't been appended yet, called with of.m and baseM held.
+func (of *openFile) flushAppend(ctx context.Context, size int64) error {
+	if size > of.appended {
+		ar := newAppendOp(ctx, of.Name(), of.f.RemotePath(), of.appended, size-of.appended, of.f.ETag)
+		if err := of.f.mfs.sync(ctx, &ar); err != nil {
+			return err
+		}
+
+		// appends can't be journaled, the changes stay dirty when
+		// failing.
+		if err := <-ar.Error; err != nil {
+			return err
+		}
+
+		of.f.ETag = ar.ETag
+		of.appended = size
+	}
+
+	// update cache
+	if err := of.f.mfs.db.Update(func(tx *meta.Tx) error {
+		if err := of.clearDirty(tx); err != nil {
+			return err
+		}
+		return of.f.store(tx)
+	}); err != nil {
+		return err
+	}
+
+	of.storeDirty(false)
+	return nil
+}
+
+// appendOp uploads the appended bytes as a temporary part object, and
+// composes the target of its current content and the part server side.
+func (mfs *MinFS) appendOp(req *AppendOperation) error {
+	if req.Length <= 0 {
+		return nil
+	}
+
+	ctx := req.ctx
+	objInfo, err := mfs.statObject(ctx, req.Target)
+	if err != nil {
+		return err
+	} else if objInfo.ETag != req.ETag {
+		return errStale
+	}
+
+	r, err := os.Open(req.Source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer interruptOnDone(ctx, r)()
+
+	// the part is stored in the bucket of the target
+	root, _ := mfs.splitRoot(req.Target)
+	part := partPrefix + nextSuffix()
+	if err = mfs.s3(ctx, "PutObject", mfs.joinPath(root, part), func() error {
+		n, perr := mfs.putObject(ctx, mfs.joinPath(root, part), mfs.uploadReader(ctx, io.NewSectionReader(r, req.Offset, req.Length)), req.Length, "", mfs.sseHeaders())
+		mfs.metrics.uploaded.Add(uint64(n))
+		return perr
+	}); err != nil {
+		return err
+	}
+
+	defer func() {
+		if rerr := mfs.removeObject(mfs.joinPath(root, part)); rerr != nil {
+			mfs.log.Errorf("Unable to remove part %s: %s\n", part, rerr)
+		}
+	}()
+
+	// composing replaces the metadata, which is copied over
+	header := mfs.copyHeaders(req.Target, objInfo)
+	header.Set("Content-Type", objInfo.ContentType)
+	copyUserMetadata(header, objInfo)
+
+	srcs := []composeSource{
+		{path: req.Target, size: objInfo.Size, etag: req.ETag},
+		{path: mfs.joinPath(root, part), size: req.Length},
+	}
+	if err = mfs.s3(ctx, "ComposeObject", req.Target, func() error {
+		return mfs.composeObject(ctx, req.Target, header, srcs)
+	}); err != nil {
+		return err
+	}
+
+	// ComposeObject doesn't return the etag of the new object.
+	if objInfo, err = mfs.statObject(ctx, req.Target); err != nil {
+		return err
+	}
+	req.ETag = objInfo.ETag
+	mfs.log.Printf("Append finished: %s -> %s.\n", req.Source, req.Target)
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net/http"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// header carrying the version id of objects listed as of a point in time.
+const versionIDHeader = "X-Amz-Version-Id"
+
+// errReadOnly is returned when modifying a read-only mount.
+var errReadOnly = fuse.Errno(syscall.EROFS)
+
+// readOnly returns true if the mount can't be modified.
+func (mfs *MinFS) readOnly() bool {
+	return !mfs.config.asOf.IsZero()
+}
+
+// namespace returns the bucket of the cache database with the files of
+// the mount. Mounts as of a point in time have a namespace of their own.
+func (mfs *MinFS) namespace() string {
+	if mfs.config.asOf.IsZero() {
+		return "minio/"
+	}
+	return "asof-" + mfs.config.asOf.UTC().Format(time.RFC3339Nano) + "/"
+}
+
+// listDir calls fn for the objects directly below prefix, and for the
+// prefixes of the others.
+func (mfs *MinFS) listDir(ctx context.Context, prefix string, fn func(minio.ObjectInfo) error) error {
+	if mfs.layered() {
+		return mfs.listLayers(ctx, prefix, fn)
+	} else if mfs.config.asOf.IsZero() {
+		return mfs.listObjects(ctx, prefix, false, fn)
+	}
+	return mfs.listObjectsAt(ctx, prefix, fn)
+}
+
+// latestVersions returns the newest version or delete marker of every
+// key at or before the time of the mount, and the listed prefixes.
+func (mfs *MinFS) latestVersions(ctx context.Context, prefix string, recursive bool) (map[string]objectVersion, []string, error) {
+	latest := map[string]objectVersion{}
+	prefixes := []string{}
+	if err := mfs.listVersions(ctx, prefix, recursive, func(version objectVersion) error {
+		if version.Prefix {
+			prefixes = append(prefixes, version.Key)
+			return nil
+		}
+
+		if mfs.isInternal(version.Key) || version.LastModified.After(mfs.config.asOf) {
+			return nil
+		}
+
+		if current, ok := latest[version.Key]; !ok || version.LastModified.After(current.LastModified) {
+			latest[version.Key] = version
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return latest, prefixes, nil
+}
+
+// listObjectsAt calls fn for the objects directly below prefix as they
+// were at the time of the mount, with the version id in the metadata,
+// and for the prefixes with objects at that time.
+func (mfs *MinFS) listObjectsAt(ctx context.Context, prefix string, fn func(minio.ObjectInfo) error) error {
+	latest, prefixes, err := mfs.latestVersions(ctx, prefix, false)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range latest {
+		if version.DeleteMarker {
+			continue
+		}
+
+		if err := fn(minio.ObjectInfo{
+			Key:          version.Key,
+			ETag:         version.ETag,
+			Size:         version.Size,
+			LastModified: version.LastModified,
+			Metadata:     http.Header{versionIDHeader: {version.VersionID}},
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range prefixes {
+		if ok, err := mfs.existedAt(ctx, p); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+
+		if err := fn(minio.ObjectInfo{Key: p}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existedAt returns true if an object below prefix existed at the time of
+// the mount.
+func (mfs *MinFS) existedAt(ctx context.Context, prefix string) (bool, error) {
+	latest, _, err := mfs.latestVersions(ctx, prefix, true)
+	if err != nil {
+		return false, err
+	}
+
+	for _, version := range latest {
+		if !version.DeleteMarker {
+			return true, nil
+		}
+	}
+	return false, nil
+}
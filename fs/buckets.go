@@ -0,0 +1,175 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"path"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// When the target has no bucket, all buckets of the endpoint are mounted
+// as top-level directories. Remote paths then start with the bucket,
+// followed by the key of the object.
+
+// errNotInBucket is returned for files and renames outside of buckets.
+var errNotInBucket = fuse.Errno(syscall.EPERM)
+
+// allBuckets returns true if all buckets of the endpoint are mounted.
+func (mfs *MinFS) allBuckets() bool {
+	return mfs.config.bucket == "" && !mfs.isUnion()
+}
+
+// splitRoot returns the bucket or the union source remotePath starts
+// with, empty when mounting a single bucket, and the key of the object.
+func (mfs *MinFS) splitRoot(remotePath string) (root, key string) {
+	if !mfs.allBuckets() && !mfs.isUnion() {
+		return "", remotePath
+	}
+
+	if i := strings.Index(remotePath, "/"); i >= 0 {
+		return remotePath[:i], remotePath[i+1:]
+	}
+	return remotePath, ""
+}
+
+// splitPath returns the bucket and the key of the object remotePath.
+func (mfs *MinFS) splitPath(remotePath string) (bucket, key string) {
+	root, key := mfs.splitRoot(remotePath)
+	if src := mfs.source(root); src != nil {
+		return src.bucket, key
+	} else if root == "" {
+		return mfs.config.bucket, key
+	}
+	return root, key
+}
+
+// joinPath returns the remote path of key in the bucket or union source
+// root.
+func (mfs *MinFS) joinPath(root, key string) string {
+	if !mfs.allBuckets() && !mfs.isUnion() {
+		return key
+	} else if key == "" {
+		return root
+	}
+	return root + "/" + key
+}
+
+// remotePath returns the remote path of the path p within the mount.
+func (mfs *MinFS) remotePath(p string) string {
+	if mfs.isUnion() {
+		return mfs.unionPath(p)
+	} else if !mfs.allBuckets() {
+		return path.Join(mfs.config.basePath, mfs.encodePath(p))
+	}
+
+	// bucket names aren't encrypted
+	bucket, rel := mfs.splitRoot(p)
+	return mfs.joinPath(bucket, mfs.encodePath(rel))
+}
+
+// internalPath returns the remote path of the internal object of
+// remotePath below prefix, in the bucket of remotePath.
+func (mfs *MinFS) internalPath(prefix, remotePath string) string {
+	root, key := mfs.splitRoot(remotePath)
+	return mfs.joinPath(root, path.Join(prefix, key))
+}
+
+// isInternal returns true if remotePath is an object used by MinFS itself.
+func (mfs *MinFS) isInternal(remotePath string) bool {
+	_, key := mfs.splitRoot(remotePath)
+	return strings.HasPrefix(key, internalPrefix)
+}
+
+// volumeName returns the name of the mounted volume, the host of the
+// endpoint when mounting all of its buckets or a union.
+func (mfs *MinFS) volumeName() string {
+	if mfs.allBuckets() || mfs.isUnion() {
+		return mfs.config.target.Host
+	}
+	return mfs.config.bucket
+}
+
+// isBucket returns true if dir is a mounted bucket.
+func (dir *Dir) isBucket() bool {
+	return dir.dir != nil && dir.dir.dir == nil && dir.dir.mfs.allBuckets()
+}
+
+// isBuckets returns true if dir is the root directory with the mounted
+// buckets.
+func (dir *Dir) isBuckets() bool {
+	return dir.dir == nil && dir.mfs.allBuckets()
+}
+
+// bucketNamespace returns the bucket of the cache database with the files
+// of the mounted bucket.
+func (mfs *MinFS) bucketNamespace(bucket string) string {
+	return strings.TrimSuffix(mfs.namespace(), "/") + ":" + bucket + "/"
+}
+
+// listBuckets calls fn for every bucket of the endpoint, as a prefix.
+func (mfs *MinFS) listBuckets(ctx context.Context, fn func(minio.ObjectInfo) error) error {
+	var buckets []minio.BucketInfo
+	if err := mfs.s3(ctx, "ListBuckets", "", func() (err error) {
+		buckets, err = mfs.api.ListBuckets()
+		return err
+	}); err != nil {
+		return err
+	}
+
+	for _, bucket := range buckets {
+		if err := fn(minio.ObjectInfo{
+			Key:          bucket.Name + "/",
+			LastModified: bucket.CreationDate,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeBucket creates the bucket of a new top-level directory.
+func (mfs *MinFS) makeBucket(ctx context.Context, bucket string) error {
+	return mfs.s3(ctx, "MakeBucket", bucket, func() error {
+		return mfs.api.MakeBucket(bucket, "")
+	})
+}
+
+// removeBucket removes the empty bucket of a top-level directory, and
+// its namespace.
+func (mfs *MinFS) removeBucket(ctx context.Context, tx *meta.Tx, bucket string) error {
+	if err := mfs.s3(ctx, "RemoveBucket", bucket, func() error {
+		return mfs.api.RemoveBucket(bucket)
+	}); err != nil {
+		return err
+	}
+	return deleteNamespace(tx, mfs.bucketNamespace(bucket))
+}
+
+// deleteNamespace removes the namespace of a bucket which has been
+// removed.
+func deleteNamespace(tx *meta.Tx, namespace string) error {
+	if tx.Tx.Bucket([]byte(namespace)) == nil {
+		return nil
+	}
+	return tx.DeleteBucket([]byte(namespace))
+}
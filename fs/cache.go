@@ -0,0 +1,248 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+// interval of the background eviction.
+const evictInterval = 10 * time.Second
+
+var _ = meta.RegisterExt(5, cacheEntry{})
+
+// cacheEntry records the use of a cache file, used for eviction.
+type cacheEntry struct {
+	CachePath string
+	Size      int64
+	Atime     time.Time
+}
+
+func cacheBucket(tx *meta.Tx) *meta.Bucket {
+	return tx.Bucket("cache/")
+}
+
+// cacheLimited returns true if the size of the cache is bounded.
+func (mfs *MinFS) cacheLimited() bool {
+	return mfs.config.cacheSize > 0 || mfs.config.cacheMinFree > 0
+}
+
+// touchCache records an access of cachePath with the given size.
+func (mfs *MinFS) touchCache(tx *meta.Tx, cachePath string, size int64) error {
+	return cacheBucket(tx).Put(path.Base(cachePath), cacheEntry{
+		CachePath: cachePath,
+		Size:      size,
+		Atime:     time.Now().UTC(),
+	})
+}
+
+// forgetCache removes the entries of removed cache files.
+func (mfs *MinFS) forgetCache(cachePaths ...string) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		for _, cachePath := range cachePaths {
+			if err := cacheBucket(tx).Delete(path.Base(cachePath)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// cacheFree returns the free space of the filesystem of the cache.
+func (mfs *MinFS) cacheFree() (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mfs.config.cache, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// cacheFull returns true if n more bytes exceed the limits of the cache.
+func (mfs *MinFS) cacheFull(n int64) bool {
+	if mfs.config.cacheSize > 0 && atomic.LoadInt64(&mfs.cacheUsed)+n > mfs.config.cacheSize {
+		return true
+	}
+
+	if mfs.config.cacheMinFree > 0 {
+		free, err := mfs.cacheFree()
+		if err != nil || free-n < mfs.config.cacheMinFree {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveCache accounts n more bytes of cache, evicting clean entries if
+// necessary. Fails with ENOSPC if the space can't be freed.
+func (mfs *MinFS) reserveCache(n int64) error {
+	if !mfs.cacheLimited() || n <= 0 {
+		return nil
+	}
+
+	if mfs.cacheFull(n) {
+		if err := mfs.evict(n); err != nil {
+			return err
+		}
+		if mfs.cacheFull(n) {
+			return fuse.Errno(syscall.ENOSPC)
+		}
+	}
+
+	atomic.AddInt64(&mfs.cacheUsed, n)
+	return nil
+}
+
+// releaseCache accounts n bytes of cache less, which have been reserved
+// but not used or have been truncated.
+func (mfs *MinFS) releaseCache(n int64) {
+	if !mfs.cacheLimited() || n == 0 {
+		return
+	}
+	atomic.AddInt64(&mfs.cacheUsed, -n)
+}
+
+// removeCacheFile removes the cache file at cachePath and releases its
+// space.
+func (mfs *MinFS) removeCacheFile(cachePath string) error {
+	fi, err := os.Stat(cachePath)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(cachePath); err != nil {
+		return err
+	}
+	mfs.releaseCache(fi.Size())
+	return nil
+}
+
+// evict removes the least recently used cache files which are neither
+// dirty, journaled nor open, until n more bytes fit in the cache.
+func (mfs *MinFS) evict(n int64) error {
+	mfs.evictM.Lock()
+	defer mfs.evictM.Unlock()
+
+	if !mfs.cacheFull(n) {
+		return nil
+	}
+
+	entries := []cacheEntry{}
+	pinned := map[string]bool{}
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		if err := dirtyBucket(tx).ForEach(func(k string, o interface{}) error {
+			if entry, ok := o.(dirtyFile); ok {
+				pinned[entry.CachePath] = true
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := journalBucket(tx).ForEach(func(k string, o interface{}) error {
+			if entry, ok := o.(journalEntry); ok {
+				pinned[entry.CachePath] = true
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return cacheBucket(tx).ForEach(func(k string, o interface{}) error {
+			if entry, ok := o.(cacheEntry); ok {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Atime.Before(entries[j].Atime)
+	})
+
+	evicted := []string{}
+	for _, entry := range entries {
+		if !mfs.cacheFull(n) {
+			break
+		}
+
+		if pinned[entry.CachePath] {
+			continue
+		}
+
+		unused, err := mfs.handles.removeUnused(entry.CachePath, mfs.removeCacheFile)
+		if !unused {
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			mfs.logger(subsystemCache).WithField("path", entry.CachePath).Warnln("Unable to evict cache file.", err)
+			continue
+		} else if err == nil {
+			mfs.logger(subsystemCache).WithField("path", entry.CachePath).Debugln("Evicted cache file.")
+		}
+
+		evicted = append(evicted, entry.CachePath)
+	}
+
+	if len(evicted) == 0 {
+		return nil
+	}
+
+	// the caller may be within a writable transaction
+	go func() {
+		if err := mfs.forgetCache(evicted...); err != nil {
+			mfs.logger(subsystemCache).Warnln("Unable to remove evicted cache entries.", err)
+		}
+	}()
+	return nil
+}
+
+// startEviction evicts cache files in the background until doneCh is
+// closed.
+func (mfs *MinFS) startEviction(doneCh chan struct{}) error {
+	// the usage is only measured once, then kept up to date
+	used, err := mfs.cacheSize()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&mfs.cacheUsed, used)
+
+	go func() {
+		ticker := time.NewTicker(evictInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+			}
+
+			if err := mfs.evict(0); err != nil {
+				mfs.logger(subsystemCache).Warnln("Unable to evict cache files.", err)
+			}
+		}
+	}()
+	return nil
+}
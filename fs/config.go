@@ -17,6 +17,7 @@
 package minfs
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -24,7 +25,9 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/minio/mc/pkg/console"
 )
 
@@ -41,7 +44,104 @@ type Config struct {
 	target      *url.URL
 	mountpoint  string
 	insecure    bool
-	debug       bool
+
+	// CA bundle trusted in addition to the system roots, client
+	// certificate and key, and minimum TLS version of connections to the
+	// server. The files are reread on SIGHUP.
+	caCert        string
+	cert          string
+	key           string
+	tlsMinVersion string
+
+	// maximum time to wait for pending uploads on shutdown.
+	shutdownTimeout time.Duration
+
+	// policy for dirty cache files left from a previous run.
+	recoverPolicy string
+
+	// serve from the cache while the server is unreachable, checking the
+	// connectivity every probeInterval.
+	offline       bool
+	probeInterval time.Duration
+
+	// number of retries of transient S3 failures, and the wait before the
+	// first retry.
+	retries      int
+	retryBackoff time.Duration
+
+	// maximum read-ahead window of sequential reads, and the number of
+	// windows fetched at once. Files opened read-only are fetched when
+	// read, instead of on open, unless zero.
+	readAhead        int64
+	readAheadWorkers int
+
+	// number of objects copied at once by directory renames.
+	renameWorkers int
+
+	// validity of presigned urls of files, unless requested otherwise.
+	shareExpiry time.Duration
+
+	// maximum upload and download rates in bytes per second, unlimited
+	// if zero, unless a window of the schedule sets other ones.
+	maxUploadRate   int64
+	maxDownloadRate int64
+	rateSchedule    []rateWindow
+
+	// address of the metrics listener, disabled if empty.
+	metrics string
+
+	// server side encryption of uploads, with the key id for kms or
+	// the customer provided key.
+	sse         string
+	sseKMSKeyID string
+	sseCKey     []byte
+
+	// mount read-only, with the files as they were at asOf.
+	asOf time.Time
+
+	// detect content types of uploads from their first bytes, with
+	// magics consulted before the builtin ones. Types set by mimeTypes
+	// take precedence.
+	mimeSniff  bool
+	mimeMagics []magic
+	mimeTypes  []pathRule
+
+	// sources of a union mount, mounting the target only if nil.
+	union *UnionConfig
+
+	// expose the versions of files in .versions directories.
+	versions bool
+
+	// storage class of uploads, unless a rule matches, and the days
+	// archived objects are restored for when read.
+	storageClass string
+	storageRules []pathRule
+	restoreDays  int
+
+	// client side encryption of contents with either a 32 byte key or
+	// a passphrase, and optionally of object names.
+	encryptKey        []byte
+	encryptPassphrase []byte
+	encryptNames      bool
+
+	// maximum size of the cache and minimum free space of its
+	// filesystem in bytes, unbounded if zero.
+	cacheSize    int64
+	cacheMinFree int64
+
+	// hold lease objects in the bucket while files are open for
+	// writing, expiring unless renewed within leaseTTL.
+	leases   bool
+	leaseTTL time.Duration
+
+	// subsystems with debug logging, all if empty.
+	debug map[string]bool
+
+	logFile       string
+	logFormat     string
+	logLevel      logrus.Level
+	logMaxSize    int64
+	logMaxBackups int
 
 	uid  uint32
 	gid  uint32
@@ -119,18 +219,31 @@ func Target(target string) func(*Config) {
 	return func(cfg *Config) {
 		if u, err := url.Parse(target); err == nil {
 			cfg.target = u
+			cfg.bucket, cfg.basePath = splitTarget(u)
+		}
+	}
+}
 
-			if len(u.Path) > 1 {
-				parts := strings.Split(u.Path[1:], "/")
-				if len(parts) >= 0 {
-					cfg.bucket = parts[0]
-				}
-				if len(parts) >= 1 {
-					cfg.basePath = path.Join(parts[1:]...)
-				}
-			}
+// splitTarget returns the bucket and the base path of the target url.
+func splitTarget(u *url.URL) (bucket, basePath string) {
+	if len(u.Path) > 1 {
+		parts := strings.Split(u.Path[1:], "/")
+		if len(parts) >= 0 {
+			bucket = parts[0]
+		}
+		if len(parts) >= 1 {
+			basePath = path.Join(parts[1:]...)
 		}
 	}
+	return bucket, basePath
+}
+
+// Union - mounts the sources of union instead of the bucket of the target,
+// whose endpoint is the default one of the sources.
+func Union(union *UnionConfig) func(*Config) {
+	return func(cfg *Config) {
+		cfg.union = union
+	}
 }
 
 // CacheDir - cache directory path option for Config
@@ -161,10 +274,292 @@ func Insecure() func(*Config) {
 	}
 }
 
-// Debug - enables debug logging.
-func Debug() func(*Config) {
+// CACert - trusts the CA certificates of the PEM file name.
+func CACert(name string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.caCert = name
+	}
+}
+
+// ClientCert - authenticates with the certificate of the PEM file name.
+func ClientCert(name string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.cert = name
+	}
+}
+
+// ClientKey - sets the private key of the client certificate.
+func ClientKey(name string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.key = name
+	}
+}
+
+// TLSMinVersion - sets the minimum TLS version, e.g. 1.2.
+func TLSMinVersion(version string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.tlsMinVersion = version
+	}
+}
+
+// Debug - enables debug logging, limited to the given subsystems if any.
+func Debug(subsystems ...string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logLevel = logrus.DebugLevel
+		for _, subsystem := range subsystems {
+			cfg.debug[subsystem] = true
+		}
+	}
+}
+
+// LogFile - sets the path of the log file.
+func LogFile(path string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logFile = path
+	}
+}
+
+// LogFormat - sets the log format, either logfmt or json.
+func LogFormat(format string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logFormat = format
+	}
+}
+
+// LogLevel - sets the minimum level of logged messages.
+func LogLevel(level logrus.Level) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logLevel = level
+	}
+}
+
+// LogRotate - rotates the log file when it exceeds size bytes and keeps
+// backups rotated files.
+func LogRotate(size int64, backups int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logMaxSize = size
+		cfg.logMaxBackups = backups
+	}
+}
+
+// Retries - retries transient S3 failures retries times, waiting backoff
+// before the first retry and doubling the wait with every retry.
+func Retries(retries int, backoff time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.retries = retries
+		cfg.retryBackoff = backoff
+	}
+}
+
+// RenameWorkers - number of objects copied at once when renaming
+// directories.
+func RenameWorkers(workers int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.renameWorkers = workers
+	}
+}
+
+// ShareExpiry - validity of presigned urls of files.
+func ShareExpiry(expiry time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.shareExpiry = expiry
+	}
+}
+
+// ShutdownTimeout - maximum time to wait for pending uploads on shutdown.
+func ShutdownTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.shutdownTimeout = timeout
+	}
+}
+
+// RecoverPolicy - sets the policy for dirty cache files left from a
+// previous run, one of RecoverUpload, RecoverLostFound or RecoverDiscard.
+func RecoverPolicy(policy string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.recoverPolicy = policy
+	}
+}
+
+// Offline - enables offline mode, in which listings, attributes and
+// cached content are served from the cache while the server is
+// unreachable, and uploads are journaled until it is reachable again.
+func Offline(probeInterval time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.offline = true
+		cfg.probeInterval = probeInterval
+	}
+}
+
+// SSE - requests server side encryption of uploads with keys managed by
+// the server (SSES3), a key management service (SSEKMS, with an optional
+// key id) or provided by the client (SSEC, with a 32 byte key).
+func SSE(mode, kmsKeyID string, key []byte) func(*Config) {
+	return func(cfg *Config) {
+		cfg.sse = mode
+		cfg.sseKMSKeyID = kmsKeyID
+		cfg.sseCKey = key
+	}
+}
+
+// AsOf - mounts read-only, with the files of a versioned bucket as they
+// were at t.
+func AsOf(t time.Time) func(*Config) {
+	return func(cfg *Config) {
+		cfg.asOf = t
+	}
+}
+
+// MimeSniff - detects the content type of uploads from their first bytes,
+// instead of their extension.
+func MimeSniff() func(*Config) {
+	return func(cfg *Config) {
+		cfg.mimeSniff = true
+	}
+}
+
+// MimeMagic - detects contentType by the magic bytes at offset, before the
+// builtin detection.
+func MimeMagic(offset int, magicBytes []byte, contentType string) func(*Config) {
 	return func(cfg *Config) {
-		cfg.debug = true
+		cfg.mimeMagics = append(cfg.mimeMagics, magic{offset, magicBytes, contentType})
+	}
+}
+
+// MimeType - sets the content type of files matching the glob pattern,
+// e.g. *.log. The first matching pattern applies.
+func MimeType(pattern, contentType string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.mimeTypes = append(cfg.mimeTypes, newPathRule(pattern, contentType))
+	}
+}
+
+// Versions - exposes the versions of the files of every directory in a
+// hidden, read-only .versions directory.
+func Versions() func(*Config) {
+	return func(cfg *Config) {
+		cfg.versions = true
+	}
+}
+
+// StorageClass - sets the storage class of uploads, e.g.
+// REDUCED_REDUNDANCY.
+func StorageClass(class string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.storageClass = class
+	}
+}
+
+// StorageRule - sets the storage class of uploads to paths matching the
+// glob pattern, e.g. *.log or archive/**. The first matching rule applies.
+func StorageRule(pattern, class string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.storageRules = append(cfg.storageRules, newPathRule(pattern, class))
+	}
+}
+
+// Restore - requests a restore of archived objects for days when they are
+// read.
+func Restore(days int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.restoreDays = days
+	}
+}
+
+// Encrypt - encrypts file contents before upload, with the 32 byte key.
+func Encrypt(key []byte) func(*Config) {
+	return func(cfg *Config) {
+		cfg.encryptKey = key
+	}
+}
+
+// EncryptPassphrase - encrypts file contents before upload, with a key
+// derived from passphrase. Surrounding white space is ignored.
+func EncryptPassphrase(passphrase []byte) func(*Config) {
+	return func(cfg *Config) {
+		cfg.encryptPassphrase = passphrase
+	}
+}
+
+// EncryptNames - encrypts object names as well, requires Encrypt.
+func EncryptNames() func(*Config) {
+	return func(cfg *Config) {
+		cfg.encryptNames = true
+	}
+}
+
+// CacheSize - bounds the size of the cache folder, file contents are
+// kept after close and evicted least recently used first.
+func CacheSize(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.cacheSize = size
+	}
+}
+
+// CacheMinFree - keeps at least free bytes available on the filesystem
+// of the cache folder, evicting cached file contents if necessary.
+func CacheMinFree(free int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.cacheMinFree = free
+	}
+}
+
+// Leases - enables locking across hosts, files open for writing are
+// leased through lease objects in the bucket, which expire after ttl
+// unless renewed.
+func Leases(ttl time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.leases = true
+		cfg.leaseTTL = ttl
+	}
+}
+
+// ReadAhead - fetches files opened read-only when read, reading ahead of
+// sequential reads with windows of up to window bytes.
+func ReadAhead(window int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.readAhead = window
+	}
+}
+
+// ReadAheadWorkers - sets the number of windows read ahead at once.
+func ReadAheadWorkers(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.readAheadWorkers = n
+	}
+}
+
+// MaxUploadRate - limits uploads to rate bytes per second.
+func MaxUploadRate(rate int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.maxUploadRate = rate
+	}
+}
+
+// MaxDownloadRate - limits downloads to rate bytes per second.
+func MaxDownloadRate(rate int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.maxDownloadRate = rate
+	}
+}
+
+// RateSchedule - limits uploads and downloads to the rates in bytes per
+// second between the times of day from and to, unlimited if zero.
+func RateSchedule(from, to time.Duration, upload, download int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.rateSchedule = append(cfg.rateSchedule, rateWindow{
+			from:     from,
+			to:       to,
+			upload:   upload,
+			download: download,
+		})
+	}
+}
+
+// Metrics - serves prometheus metrics on address.
+func Metrics(address string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.metrics = address
 	}
 }
 
@@ -179,8 +574,100 @@ func (cfg *Config) validate() error {
 		return errors.New("Target not set")
 	}
 
-	if cfg.bucket == "" {
-		return errors.New("Bucket not set")
+	if cfg.union != nil {
+		if cfg.bucket != "" {
+			return errors.New("Union mounts take an endpoint without bucket as target")
+		} else if !cfg.asOf.IsZero() || cfg.versions {
+			return errors.New("Union mounts can't be combined with asof or versions")
+		} else if err := cfg.union.validate(); err != nil {
+			return err
+		}
+	}
+
+	if (cfg.cert == "") != (cfg.key == "") {
+		return errors.New("Client certificate and key should be set together")
+	}
+
+	if _, ok := tlsVersions[cfg.tlsMinVersion]; !ok && cfg.tlsMinVersion != "" {
+		return errors.New("TLS min version should be 1.0, 1.1, 1.2 or 1.3")
+	}
+
+	switch cfg.recoverPolicy {
+	case RecoverUpload, RecoverLostFound, RecoverDiscard:
+	default:
+		return errors.New("Recover policy should be upload, lostfound or discard")
+	}
+
+	switch cfg.sse {
+	case "", SSES3, SSEKMS:
+	case SSEC:
+		if len(cfg.sseCKey) != 32 {
+			return errors.New("Customer provided encryption key should be 32 bytes")
+		}
+	default:
+		return errors.New("Server side encryption should be s3, kms or c")
+	}
+
+	if cfg.renameWorkers < 1 {
+		return errors.New("Rename workers should be at least 1")
+	}
+
+	if cfg.readAhead != 0 && cfg.readAhead < minReadAhead {
+		return errors.New("Read-ahead window should be at least 128K")
+	} else if cfg.readAheadWorkers < 1 {
+		return errors.New("Read-ahead workers should be at least 1")
+	}
+
+	if cfg.maxUploadRate < 0 || cfg.maxDownloadRate < 0 {
+		return errors.New("Rates should not be negative")
+	}
+
+	for _, w := range cfg.rateSchedule {
+		if w.from < 0 || w.from >= 24*time.Hour || w.to < 0 || w.to >= 24*time.Hour {
+			return errors.New("Rate schedule times should be within a day")
+		} else if w.upload < 0 || w.download < 0 {
+			return errors.New("Rates should not be negative")
+		}
+	}
+
+	if cfg.shareExpiry < time.Second || cfg.shareExpiry > maxShareExpiry {
+		return errors.New("Share expiry should be between 1s and 7 days")
+	}
+
+	if cfg.encryptKey != nil && cfg.encryptPassphrase != nil {
+		return errors.New("Encryption key and passphrase are exclusive")
+	} else if cfg.encryptKey != nil && len(cfg.encryptKey) != 32 {
+		return errors.New("Encryption key should be 32 bytes")
+	} else if cfg.encryptPassphrase != nil {
+		if len(bytes.TrimSpace(cfg.encryptPassphrase)) == 0 {
+			return errors.New("Encryption passphrase should not be empty")
+		}
+		// the salt of the passphrase is stored in the bucket
+		if cfg.bucket == "" || cfg.union != nil {
+			return errors.New("Encryption passphrases require a bucket, use a 32 byte key instead")
+		}
+	}
+
+	if cfg.encryptNames && cfg.encryptKey == nil && cfg.encryptPassphrase == nil {
+		return errors.New("Name encryption requires an encryption key")
+	}
+
+	if cfg.leases && cfg.leaseTTL < time.Second {
+		return errors.New("Lease ttl should be at least 1s")
+	}
+
+	if cfg.logFormat != "logfmt" && cfg.logFormat != "json" {
+		return errors.New("Log format should be logfmt or json")
+	}
+
+	for subsystem := range cfg.debug {
+		valid := false
+		for _, s := range subsystems {
+			valid = valid || s == subsystem
+		}
+		if !valid {
+			return errors.New("Unknown debug subsystem " + subsystem)
+		}
 	}
 
 	return nil
@@ -0,0 +1,274 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ControlSocketPath returns the path of the control socket used by the
+// MinFS instance serving mountpoint.
+func ControlSocketPath(mountpoint string) (string, error) {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(globalSocketDir, fmt.Sprintf("%x.sock", sha1.Sum([]byte(abs)))), nil
+}
+
+// ControlArgs - arguments for control requests without parameters.
+type ControlArgs struct{}
+
+// ShareArgs - arguments of share requests.
+type ShareArgs struct {
+	// path of the file below the mountpoint.
+	Path string
+	// validity of the url, the configured expiry if zero.
+	Expires time.Duration
+}
+
+// ThrottleArgs - arguments of throttle requests.
+type ThrottleArgs struct {
+	// limits in bytes per second outside of scheduled windows, zero is
+	// unlimited and negative unchanged.
+	Upload   int64
+	Download int64
+}
+
+// Rates - bandwidth limits in effect, in bytes per second.
+type Rates struct {
+	Upload   int64
+	Download int64
+}
+
+// Status - state of a running MinFS instance.
+type Status struct {
+	Endpoint   string
+	Bucket     string
+	Mountpoint string
+
+	// number of open file handles.
+	Handles int
+	// number of sync operations queued or in progress.
+	Queued int64
+	// total size in bytes of the cache directory.
+	CacheSize int64
+
+	// false while the server is unreachable in offline mode.
+	Online bool
+
+	// bandwidth limits in effect.
+	Rates Rates
+}
+
+// Control is the rpc service exposed on the control socket.
+type Control struct {
+	mfs *MinFS
+}
+
+// Status returns the current state of the instance.
+func (c *Control) Status(args ControlArgs, reply *Status) error {
+	mfs := c.mfs
+
+	size, err := mfs.cacheSize()
+	if err != nil {
+		return err
+	}
+
+	*reply = Status{
+		Endpoint:   mfs.config.target.Host,
+		Bucket:     mfs.config.bucket,
+		Mountpoint: mfs.config.mountpoint,
+		Handles:    mfs.handles.count(),
+		Queued:     atomic.LoadInt64(&mfs.queued),
+		CacheSize:  size,
+		Online:     !mfs.isOffline(),
+		Rates:      mfs.rates(),
+	}
+	return nil
+}
+
+// Unmount drains pending uploads and unmounts the filesystem.
+func (c *Control) Unmount(args ControlArgs, reply *ControlArgs) error {
+	return c.mfs.shutdown()
+}
+
+// Share returns a presigned url of a file.
+func (c *Control) Share(args ShareArgs, reply *string) (err error) {
+	*reply, err = c.mfs.share(context.Background(), args.Path, args.Expires)
+	return err
+}
+
+// Throttle changes the bandwidth limits, and returns the ones in effect.
+func (c *Control) Throttle(args ThrottleArgs, reply *Rates) error {
+	c.mfs.throttle.set(args.Upload, args.Download)
+	*reply = c.mfs.rates()
+	return nil
+}
+
+// rates returns the bandwidth limits in effect.
+func (mfs *MinFS) rates() Rates {
+	return Rates{
+		Upload:   mfs.throttle.uploads.getRate(),
+		Download: mfs.throttle.downloads.getRate(),
+	}
+}
+
+// startControl listens on the control socket for the mountpoint and
+// serves control requests until the listener is closed.
+func (mfs *MinFS) startControl() (net.Listener, error) {
+	socketPath, err := ControlSocketPath(mfs.config.mountpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(globalSocketDir, 0700); err != nil {
+		return nil, err
+	}
+
+	// remove a stale socket of a previous instance.
+	if err = os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	server := rpc.NewServer()
+	if err = server.Register(&Control{mfs: mfs}); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	go server.Accept(l)
+	return l, nil
+}
+
+// cacheSize returns the total size of all cache files in the cache
+// directory, without the metadata database.
+func (mfs *MinFS) cacheSize() (int64, error) {
+	var size int64
+	err := filepath.Walk(mfs.config.cache, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && p != mfs.dbPath() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// FindMountpoint returns the mountpoint of the MinFS instance serving p,
+// and the path of p below it.
+func FindMountpoint(p string) (string, string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", "", err
+	}
+
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		socketPath, err := ControlSocketPath(dir)
+		if err != nil {
+			return "", "", err
+		}
+
+		if _, err = os.Stat(socketPath); err == nil {
+			rel, err := filepath.Rel(dir, abs)
+			if err != nil {
+				return "", "", err
+			}
+			return dir, filepath.ToSlash(rel), nil
+		}
+
+		if dir == filepath.Dir(dir) {
+			return "", "", errors.New("Not within a mounted minfs")
+		}
+	}
+}
+
+// ControlClient talks to a running MinFS instance over its control socket.
+type ControlClient struct {
+	*rpc.Client
+}
+
+// DialControl connects to the MinFS instance serving mountpoint.
+func DialControl(mountpoint string) (*ControlClient, error) {
+	socketPath, err := ControlSocketPath(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := rpc.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ControlClient{client}, nil
+}
+
+// Status returns the state of the running instance.
+func (cc *ControlClient) Status() (*Status, error) {
+	status := &Status{}
+	if err := cc.Call("Control.Status", ControlArgs{}, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Unmount flushes pending writes and unmounts the running instance.
+func (cc *ControlClient) Unmount() error {
+	return cc.Call("Control.Unmount", ControlArgs{}, &ControlArgs{})
+}
+
+// Share returns a presigned url of the file at p below the mountpoint,
+// valid for expires or the configured expiry if zero.
+func (cc *ControlClient) Share(p string, expires time.Duration) (string, error) {
+	var u string
+	if err := cc.Call("Control.Share", ShareArgs{Path: p, Expires: expires}, &u); err != nil {
+		return "", err
+	}
+	return u, nil
+}
+
+// Throttle changes the bandwidth limits outside of scheduled windows,
+// negative limits are left unchanged. Returns the limits in effect.
+func (cc *ControlClient) Throttle(upload, download int64) (*Rates, error) {
+	rates := &Rates{}
+	if err := cc.Call("Control.Throttle", ThrottleArgs{Upload: upload, Download: download}, rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
@@ -80,7 +80,14 @@ func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 }
 
 // Lookup returns the file node, and scans the current dir if necessary
-func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+func (dir *Dir) Lookup(ctx context.Context, name string) (node fs.Node, err error) {
+	t := dir.mfs.trace(subsystemFuse, "lookup", path.Join(dir.FullPath(), name))
+	defer t.done(&err)
+
+	if name == versionsDirName && dir.mfs.config.versions && !dir.isBuckets() {
+		return &versionsDir{dir: dir}, nil
+	}
+
 	if err := dir.scan(ctx); err != nil {
 		return nil, err
 	}
@@ -112,7 +119,7 @@ func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 // RemotePath returns the full path including parent paths for current dir on the remote
 func (dir *Dir) RemotePath() string {
-	return path.Join(dir.mfs.config.basePath, dir.FullPath())
+	return dir.mfs.remotePath(dir.FullPath())
 }
 
 // FullPath returns the full path including parent paths for current dir
@@ -140,8 +147,10 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 		// Object already exists and accessible, update values as needed.
 		f.dir = dir
 		f.mfs = dir.mfs
-		f.Size = uint64(objInfo.Size)
+		f.Size = uint64(dir.mfs.plainSize(objInfo.Size))
 		f.ETag = objInfo.ETag
+		f.VersionID = objInfo.Metadata.Get(versionIDHeader)
+		f.Layer = layerOf(objInfo)
 		if objInfo.LastModified.After(f.Chgtime) {
 			f.Chgtime = objInfo.LastModified
 		}
@@ -164,7 +173,7 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 		f = File{
 			dir:     dir,
 			Path:    baseKey,
-			Size:    uint64(objInfo.Size),
+			Size:    uint64(dir.mfs.plainSize(objInfo.Size)),
 			Inode:   seq,
 			Mode:    dir.mfs.config.mode,
 			GID:     dir.mfs.config.gid,
@@ -174,6 +183,9 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 			Mtime:   objInfo.LastModified,
 			Atime:   objInfo.LastModified,
 			ETag:    objInfo.ETag,
+
+			VersionID: objInfo.Metadata.Get(versionIDHeader),
+			Layer:     layerOf(objInfo),
 		}
 		if err = f.store(tx); err != nil {
 			return err
@@ -218,11 +230,17 @@ func (dir *Dir) storeDir(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objIn
 	return err
 }
 
-func (dir *Dir) scan(ctx context.Context) error {
+func (dir *Dir) scan(ctx context.Context) (err error) {
+	dir.mfs.metrics.cacheHit("listing", !dir.needsScan())
 	if !dir.needsScan() {
 		return nil
 	}
 
+	// serve the listing from the cache while offline
+	if dir.mfs.isOffline() {
+		return nil
+	}
+
 	tx, err := dir.mfs.db.Begin(true)
 	if err != nil {
 		return err
@@ -249,33 +267,44 @@ func (dir *Dir) scan(ctx context.Context) error {
 		prefix = prefix + "/"
 	}
 
-	// The channel will abort the ListObjectsV2 request.
-	doneCh := make(chan struct{})
-	defer close(doneCh)
+	list := func(fn func(minio.ObjectInfo) error) error {
+		return dir.mfs.listDir(ctx, prefix, fn)
+	}
+	if dir.isBuckets() {
+		list = func(fn func(minio.ObjectInfo) error) error {
+			return dir.mfs.listBuckets(ctx, fn)
+		}
+	} else if dir.isSources() {
+		list = func(fn func(minio.ObjectInfo) error) error {
+			return dir.mfs.listSources(ctx, fn)
+		}
+	}
 
-	ch := dir.mfs.api.ListObjectsV2(dir.mfs.config.bucket, prefix, false, doneCh)
+	if err := list(func(objInfo minio.ObjectInfo) error {
+		if dir.mfs.isInternal(objInfo.Key) {
+			return nil
+		}
 
-loop:
-	for {
-		select {
-		case <-ctx.Done():
-			break loop
-		case objInfo, ok := <-ch:
-			if !ok {
-				break loop
-			}
-			key := objInfo.Key[len(prefix):]
-			baseKey := path.Base(key)
+		key := objInfo.Key[len(prefix):]
+		baseKey, ok := dir.mfs.decodeName(path.Base(key))
+		if !ok {
+			// not encrypted with our key
+			return nil
+		}
 
-			// object still exists
-			objects[baseKey] = nil
+		// object still exists
+		objects[baseKey] = nil
 
-			if strings.HasSuffix(key, "/") {
-				dir.storeDir(b, tx, baseKey, objInfo)
-			} else {
-				dir.storeFile(b, tx, baseKey, objInfo)
-			}
+		if strings.HasSuffix(key, "/") {
+			dir.storeDir(b, tx, baseKey, objInfo)
+		} else {
+			dir.storeFile(b, tx, baseKey, objInfo)
 		}
+		return nil
+	}); err == errOffline {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
 	// cache housekeeping
@@ -291,6 +320,11 @@ loop:
 			continue
 		}
 
+		if dir.isBuckets() {
+			deleteNamespace(tx, dir.mfs.bucketNamespace(k))
+			continue
+		}
+
 		b.DeleteBucket(k + "/")
 	}
 
@@ -303,12 +337,15 @@ loop:
 }
 
 // ReadDirAll will return all files in current dir
-func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+func (dir *Dir) ReadDirAll(ctx context.Context) (entries []fuse.Dirent, err error) {
+	t := dir.mfs.trace(subsystemFuse, "readdir", dir.FullPath())
+	defer t.done(&err)
+
 	if err := dir.scan(ctx); err != nil {
 		return nil, err
 	}
 
-	var entries = []fuse.Dirent{}
+	entries = []fuse.Dirent{}
 
 	// update cache folder with bucket list
 	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
@@ -335,7 +372,9 @@ func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 func (dir *Dir) bucket(tx *meta.Tx) *meta.Bucket {
 	// Root folder.
 	if dir.dir == nil {
-		return tx.Bucket("minio/")
+		return tx.Bucket(dir.mfs.namespace())
+	} else if dir.isBucket() {
+		return tx.Bucket(dir.dir.mfs.bucketNamespace(dir.Path))
 	}
 
 	b := dir.dir.bucket(tx)
@@ -344,7 +383,23 @@ func (dir *Dir) bucket(tx *meta.Tx) *meta.Bucket {
 }
 
 // Mkdir will make a new directory below current dir
-func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (node fs.Node, err error) {
+	t := dir.mfs.trace(subsystemFuse, "mkdir", path.Join(dir.FullPath(), req.Name))
+	defer t.done(&err)
+
+	if dir.mfs.readOnly() {
+		return nil, errReadOnly
+	}
+
+	// only uploads are journaled while offline
+	if dir.mfs.isOffline() {
+		return nil, errReadOnly
+	}
+
+	if dir.isSources() {
+		return nil, errNotInBucket
+	}
+
 	subdir := Dir{
 		dir: dir,
 		mfs: dir.mfs,
@@ -361,6 +416,13 @@ func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 		Atime:   time.Now(),
 	}
 
+	// directories below the root are buckets
+	if dir.isBuckets() {
+		if err := dir.mfs.makeBucket(ctx, req.Name); err != nil {
+			return nil, err
+		}
+	}
+
 	tx, err := dir.mfs.db.Begin(true)
 	if err != nil {
 		return nil, err
@@ -381,9 +443,21 @@ func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 }
 
 // Remove will delete a file or directory from current directory
-func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if err := dir.mfs.wait(path.Join(dir.FullPath(), req.Name)); err != nil {
-		return err
+func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	t := dir.mfs.trace(subsystemFuse, "remove", path.Join(dir.FullPath(), req.Name))
+	defer t.done(&err)
+
+	if dir.mfs.readOnly() {
+		return errReadOnly
+	}
+
+	// only uploads are journaled while offline
+	if dir.mfs.isOffline() {
+		return errReadOnly
+	}
+
+	if dir.isSources() {
+		return errNotInBucket
 	}
 
 	tx, err := dir.mfs.db.Begin(true)
@@ -400,15 +474,25 @@ func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		return fuse.ENOENT
 	} else if err != nil {
 		return err
+	} else if file, ok := o.(File); ok && file.Layer > 0 {
+		// lower layers are read-only
+		return errReadOnly
 	} else if err := b.Delete(req.Name); err != nil {
 		return err
 	}
 
+	if dir.isBuckets() {
+		if err := dir.mfs.removeBucket(ctx, tx, req.Name); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
 	if req.Dir {
 		b.DeleteBucket(req.Name + "/")
 	}
 
-	if err := dir.mfs.api.RemoveObject(dir.mfs.config.bucket, path.Join(dir.RemotePath(), req.Name)); err != nil {
+	if err := dir.mfs.removeObject(path.Join(dir.RemotePath(), dir.mfs.encodeName(req.Name))); err != nil {
 		return err
 	}
 
@@ -421,7 +505,12 @@ func (dir *Dir) store(tx *meta.Tx) error {
 	b := dir.dir.bucket(tx)
 
 	subbucketPath := path.Base(dir.Path)
-	if _, err := b.CreateBucketIfNotExists(subbucketPath + "/"); err != nil {
+	if dir.isBucket() {
+		// buckets have a namespace of their own
+		if _, err := tx.CreateBucketIfNotExists([]byte(dir.dir.mfs.bucketNamespace(dir.Path))); err != nil {
+			return err
+		}
+	} else if _, err := b.CreateBucketIfNotExists(subbucketPath + "/"); err != nil {
 		return err
 	}
 
@@ -435,78 +524,148 @@ func (dir *Dir) Dirent() fuse.Dirent {
 	}
 }
 
-// Create will return a new empty file in current dir, if the file is currently locked, it will
-// wait for the lock to be freed.
-func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	if err := dir.mfs.wait(path.Join(dir.FullPath(), req.Name)); err != nil {
+// Create will return a new empty file in current dir, if the file is currently open, the new
+// handle shares its cache file.
+func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (node fs.Node, handle fs.Handle, err error) {
+	t := dir.mfs.trace(subsystemFuse, "create", path.Join(dir.FullPath(), req.Name))
+	defer t.done(&err)
+
+	if dir.mfs.isDraining() {
+		return nil, nil, errShuttingDown
+	}
+
+	if dir.mfs.readOnly() {
+		return nil, nil, errReadOnly
+	}
+
+	if dir.isBuckets() || dir.isSources() {
+		return nil, nil, errNotInBucket
+	}
+
+	// the metadata is updated without holding the open file, which is
+	// locked before the metadata elsewhere.
+	var (
+		f       File
+		created bool
+	)
+	if err = dir.mfs.db.Update(func(tx *meta.Tx) error {
+		if gerr := dir.bucket(tx).Get(req.Name, &f); gerr == nil {
+			f.mfs = dir.mfs
+			f.dir = dir
+		} else if i, nerr := dir.mfs.NextSequence(tx); nerr != nil {
+			return nerr
+		} else {
+			f = File{
+				mfs: dir.mfs,
+				dir: dir,
+
+				Size:    uint64(0),
+				Inode:   i,
+				Path:    req.Name,
+				Mode:    req.Mode, // dir.mfs.config.mode, // should we use same mode for scan?
+				UID:     dir.mfs.config.uid,
+				GID:     dir.mfs.config.gid,
+				Chgtime: time.Now().UTC(),
+				Crtime:  time.Now().UTC(),
+				Mtime:   time.Now().UTC(),
+				Atime:   time.Now().UTC(),
+				ETag:    "",
+
+				// req.Umask
+			}
+			created = true
+		}
+		return f.store(tx)
+	}); err != nil {
 		return nil, nil, err
 	}
 
-	tx, err := dir.mfs.db.Begin(true)
+	// a file created here is removed again if the create fails
+	defer func() {
+		if err != nil && created {
+			dir.mfs.db.Update(f.delete)
+		}
+	}()
+
+	fh, err := dir.mfs.Acquire(&f, true, func() (*openFile, error) {
+		cachePath, err := dir.mfs.NewCachePath()
+		if err != nil {
+			return nil, err
+		}
+		return openCacheFile(&f, cachePath, os.O_CREATE|os.O_TRUNC)
+	})
 	if err != nil {
 		return nil, nil, err
 	}
+	t.handle = fh.handle
 
-	defer tx.Rollback()
+	// the handle is removed again if the create fails from here on, and
+	// its cache file unless it has been shared with changes meanwhile
+	defer func() {
+		if err != nil && dir.mfs.abort(fh) && !fh.of.isDirty() {
+			dir.mfs.removeCacheFile(fh.of.cachePath)
+		}
+	}()
 
-	b := dir.bucket(tx)
+	if err = fh.of.acquireLease(ctx); err != nil {
+		return nil, nil, err
+	}
 
-	name := req.Name
+	if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+		if err = fh.of.resize(0); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	var f File
-	if gerr := b.Get(name, &f); gerr == nil {
-		f.mfs = dir.mfs
-		f.dir = dir
-	} else if i, nerr := dir.mfs.NextSequence(tx); nerr != nil {
-		return nil, nil, nerr
-	} else {
-		f = File{
-			mfs: dir.mfs,
-			dir: dir,
+	if err = fh.of.setDirty(); err != nil {
+		return nil, nil, err
+	}
 
-			Size:    uint64(0),
-			Inode:   i,
-			Path:    req.Name,
-			Mode:    req.Mode, // dir.mfs.config.mode, // should we use same mode for scan?
-			UID:     dir.mfs.config.uid,
-			GID:     dir.mfs.config.gid,
-			Chgtime: time.Now().UTC(),
-			Crtime:  time.Now().UTC(),
-			Mtime:   time.Now().UTC(),
-			Atime:   time.Now().UTC(),
-			ETag:    "",
+	resp.Handle = fuse.HandleID(fh.handle)
+	return &f, fh, nil
+}
 
-			// req.Umask
-		}
-	}
+// Rename will rename files
+func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node) (err error) {
+	t := dir.mfs.trace(subsystemFuse, "rename", path.Join(dir.FullPath(), req.OldName))
+	defer t.done(&err)
 
-	if serr := f.store(tx); serr != nil {
-		return nil, nil, serr
+	if dir.mfs.readOnly() {
+		return errReadOnly
 	}
 
-	var fh *FileHandle
-	if fh, err = dir.mfs.Acquire(&f); err != nil {
-		return nil, nil, err
+	// only uploads are journaled while offline
+	if dir.mfs.isOffline() {
+		return errReadOnly
 	}
-	fh.dirty = true
-	if fh.cachePath, err = dir.mfs.NewCachePath(); err != nil {
-		return nil, nil, err
+
+	newDir := nd.(*Dir)
+
+	// buckets and sources can't be renamed, nor can files be moved out
+	// of them
+	if dir.isBuckets() || newDir.isBuckets() || dir.isSources() || newDir.isSources() {
+		return errNotInBucket
 	}
-	if fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags), dir.mfs.config.mode); err != nil {
-		return nil, nil, err
+
+	// directories are renamed on the server outside of a transaction
+	var o interface{}
+	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
+		return dir.bucket(tx).Get(req.OldName, &o)
+	}); err != nil {
+		return err
 	}
 
-	// Commit the transaction and check for error.
-	if err = tx.Commit(); err != nil {
-		return nil, nil, err
+	// objects can't be copied between sources, rename(2) callers copy
+	// them instead
+	_, isDir := o.(Dir)
+	if dir.mfs.isUnion() && dir.mfs.crossDevice(dir, newDir, isDir) {
+		return errCrossDevice
 	}
 
-	resp.Handle = fuse.HandleID(fh.handle)
-	return &f, fh, nil
-}
+	if subdir, ok := o.(Dir); ok {
+		return dir.renameDir(ctx, req, newDir, subdir)
+	}
 
-// Rename will rename files
-func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node) error {
 	tx, err := dir.mfs.db.Begin(true)
 	if err != nil {
 		return err
@@ -516,14 +675,16 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 
 	b := dir.bucket(tx)
 
-	newDir := nd.(*Dir)
-
-	var o interface{}
 	if err := b.Get(req.OldName, &o); err != nil {
 		return err
 	} else if file, ok := o.(File); ok {
 		file.dir = dir
 
+		// lower layers are read-only
+		if file.Layer > 0 {
+			return errReadOnly
+		}
+
 		if err := b.Delete(file.Path); err != nil {
 			return err
 		}
@@ -534,8 +695,8 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 		file.dir = newDir
 		file.mfs = dir.mfs
 
-		sr := newMoveOp(oldPath, file.RemotePath())
-		if err := dir.mfs.sync(&sr); err == nil {
+		sr := newMoveOp(context.Background(), oldPath, file.RemotePath())
+		if err := dir.mfs.sync(ctx, &sr); err == nil {
 		} else if meta.IsNoSuchObject(err) {
 			return fuse.ENOENT
 		} else if err != nil {
@@ -552,69 +713,6 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 			return err
 		}
 
-	} else if subdir, ok := o.(Dir); ok {
-		// rescan in case of abort / partial / failure
-		// this will repair the cache
-		dir.scanned = false
-
-		if err := b.Delete(req.OldName); err != nil {
-			return err
-		}
-
-		if err := b.DeleteBucket(req.OldName + "/"); err != nil {
-			return err
-		}
-
-		newDir.scanned = false
-
-		// fusebug?
-		// the cached node is still invalid, contains the old name
-		// but there is no way to retrieve the old node to update the new
-		// name. refreshing the parent node won't fix the issue when
-		// direct access. Fuse should add the targetnode (subdir) as well,
-		// that can be updated.
-
-		subdir.Path = req.NewName
-		subdir.dir = newDir
-		subdir.mfs = dir.mfs
-
-		if err := subdir.store(tx); err != nil {
-			return err
-		}
-
-		oldPath := path.Join(dir.RemotePath(), req.OldName)
-
-		doneCh := make(chan struct{})
-		defer close(doneCh)
-
-		ch := dir.mfs.api.ListObjectsV2(dir.mfs.config.bucket, oldPath+"/", true, doneCh)
-	loop:
-		for {
-			select {
-			case <-ctx.Done():
-				break loop
-			case message, ok := <-ch:
-				if !ok {
-					break loop
-				}
-
-				newPath := path.Join(newDir.RemotePath(), req.NewName, message.Key[len(oldPath):])
-
-				sr := newMoveOp(message.Key, newPath)
-				if err := dir.mfs.sync(&sr); err == nil {
-				} else if meta.IsNoSuchObject(err) {
-					return fuse.ENOENT
-				} else if err != nil {
-					return err
-				}
-
-				// we'll wait for the request to be uploaded and synced, before
-				// releasing the file
-				if err := <-sr.Error; err != nil {
-					return err
-				}
-			}
-		}
 	} else {
 		return fuse.ENOSYS
 	}
@@ -0,0 +1,440 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/context"
+)
+
+func keysBucket(tx *meta.Tx) *meta.Bucket {
+	return tx.Bucket("keys/")
+}
+
+// Encrypted objects start with a header of encMagic and a random salt,
+// followed by the content in chunks of encChunkSize bytes, each sealed
+// with AES-GCM. The nonce of a chunk is its index, together with a flag
+// marking the last chunk so truncated objects are detected.
+const (
+	encMagic      = "MINFSENC"
+	encSaltSize   = 32
+	encHeaderSize = len(encMagic) + encSaltSize
+	encChunkSize  = 64 << 10
+	encOverhead   = 16
+)
+
+// iterations of the key derivation from a passphrase.
+const encIterations = 100000
+
+// key of the salt object of the key derivation from a passphrase.
+const saltKey = internalPrefix + "salt"
+
+var errNotEncrypted = errors.New("Object is not encrypted by MinFS")
+
+// deriveKey returns the key for purpose derived from key.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// encryptionSalt returns the salt of the key derivation from a
+// passphrase. It is generated randomly when the bucket is first mounted
+// with encryption, stored in the bucket so all hosts derive the same key,
+// and kept in the cache for mounts while the server is unreachable.
+func (mfs *MinFS) encryptionSalt(ctx context.Context) ([]byte, error) {
+	var salt []byte
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return keysBucket(tx).Get("salt", &salt)
+	}); err == nil {
+		return salt, nil
+	} else if !meta.IsNoSuchObject(err) {
+		return nil, err
+	}
+
+	salt, err := mfs.getSalt(ctx)
+	if err == fuse.ENOENT {
+		salt = make([]byte, encSaltSize)
+		if _, err = io.ReadFull(crand.Reader, salt); err != nil {
+			return nil, err
+		}
+
+		// an other host may have stored its salt meanwhile
+		if err = mfs.putSalt(ctx, salt); err != nil && err != errLeased {
+			return nil, err
+		}
+		salt, err = mfs.getSalt(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = mfs.db.Update(func(tx *meta.Tx) error {
+		return keysBucket(tx).Put("salt", salt)
+	}); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// getSalt reads the salt object of the bucket.
+func (mfs *MinFS) getSalt(ctx context.Context) (salt []byte, err error) {
+	err = mfs.s3(ctx, "GetObject", saltKey, func() error {
+		bucket, object := mfs.splitPath(saltKey)
+		obj, gerr := mfs.api.GetObject(bucket, object)
+		if gerr != nil {
+			return gerr
+		}
+		defer obj.Close()
+
+		salt, gerr = ioutil.ReadAll(obj)
+		return gerr
+	})
+	if err == nil && len(salt) != encSaltSize {
+		return nil, fmt.Errorf("Invalid encryption salt in %s", saltKey)
+	}
+	return salt, err
+}
+
+// putSalt stores salt as the salt object of the bucket, unless there is
+// one already. Backends without conditional writes ignore the condition.
+func (mfs *MinFS) putSalt(ctx context.Context, salt []byte) error {
+	return mfs.s3(ctx, "PutObject", saltKey, func() error {
+		resp, err := mfs.request(ctx, "PUT", saltKey, nil, salt, http.Header{"If-None-Match": {"*"}})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return errLeased
+		}
+		return responseError(resp)
+	})
+}
+
+// initEncryption sets up the keys of the mount, from the key or derived
+// from the passphrase.
+func (mfs *MinFS) initEncryption(ctx context.Context) error {
+	key := mfs.config.encryptKey
+	if passphrase := mfs.config.encryptPassphrase; passphrase != nil {
+		salt, err := mfs.encryptionSalt(ctx)
+		if err != nil {
+			return err
+		}
+		key = pbkdf2.Key(bytes.TrimSpace(passphrase), salt, encIterations, 32, sha256.New)
+	}
+
+	aead, err := newGCM(deriveKey(key, "names"))
+	if err != nil {
+		return err
+	}
+
+	mfs.encryptKey, mfs.nameAEAD = key, aead
+	return nil
+}
+
+// encrypted returns true if contents are encrypted.
+func (mfs *MinFS) encrypted() bool {
+	return mfs.encryptKey != nil
+}
+
+// newGCM returns AES-GCM with key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// contentCipher returns the cipher of the object with the given salt.
+func (mfs *MinFS) contentCipher(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, deriveKey(mfs.encryptKey, "content"))
+	mac.Write(salt)
+	return newGCM(mac.Sum(nil))
+}
+
+// chunkNonce returns the nonce of chunk index.
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	if last {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+// chunkCount returns the number of chunks of size bytes of content.
+func chunkCount(size int64) int64 {
+	if size <= 0 {
+		return 1
+	}
+	return (size + encChunkSize - 1) / encChunkSize
+}
+
+// encryptedSize returns the size of the object with size bytes of content.
+func encryptedSize(size int64) int64 {
+	return int64(encHeaderSize) + size + chunkCount(size)*encOverhead
+}
+
+// plainSize returns the size of the content of an object of size bytes.
+func (mfs *MinFS) plainSize(size int64) int64 {
+	if !mfs.encrypted() {
+		return size
+	}
+
+	body := size - int64(encHeaderSize)
+	if body < encOverhead {
+		return 0
+	}
+
+	plain := (body / (encChunkSize + encOverhead)) * encChunkSize
+	if rem := body % (encChunkSize + encOverhead); rem > encOverhead {
+		plain += rem - encOverhead
+	}
+	return plain
+}
+
+// encryptReader encrypts the content read from r.
+type encryptReader struct {
+	r    io.Reader
+	aead cipher.AEAD
+
+	index, last uint64
+
+	chunk []byte
+	buf   []byte
+	done  bool
+}
+
+// newEncryptReader returns a reader of the object encrypting the size
+// bytes of content read from r.
+func (mfs *MinFS) newEncryptReader(r io.Reader, size int64) (io.Reader, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := io.ReadFull(crand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := mfs.contentCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		r:     r,
+		aead:  aead,
+		last:  uint64(chunkCount(size) - 1),
+		chunk: make([]byte, encChunkSize),
+		buf:   append([]byte(encMagic), salt...),
+	}, nil
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.buf) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(er.r, er.chunk)
+		if er.index < er.last && err != nil {
+			// content is shorter than announced
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		last := er.index == er.last
+		er.buf = er.aead.Seal(er.buf[:0], chunkNonce(er.index, last), er.chunk[:n], nil)
+		er.index++
+		er.done = last
+	}
+
+	n := copy(p, er.buf)
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+// decryptReader decrypts the chunks of an object read from r.
+type decryptReader struct {
+	r    io.Reader
+	aead cipher.AEAD
+
+	index, last uint64
+
+	chunk []byte
+	buf   []byte
+}
+
+// newDecryptReader returns a reader of the content of the object of size
+// bytes read from r.
+func (mfs *MinFS) newDecryptReader(r io.Reader, size int64) (io.Reader, error) {
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errNotEncrypted
+	} else if !strings.HasPrefix(string(header), encMagic) {
+		return nil, errNotEncrypted
+	}
+
+	aead, err := mfs.contentCipher(header[len(encMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:     r,
+		aead:  aead,
+		last:  uint64(chunkCount(mfs.plainSize(size)) - 1),
+		chunk: make([]byte, encChunkSize+encOverhead),
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.index > dr.last {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(dr.r, dr.chunk)
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && dr.index < dr.last) {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		plain, err := dr.aead.Open(dr.chunk[:0], chunkNonce(dr.index, dr.index == dr.last), dr.chunk[:n], nil)
+		if err != nil {
+			return 0, err
+		}
+
+		dr.buf = plain
+		dr.index++
+	}
+
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+// encodeName returns the object name of name. Names are encrypted
+// deterministically, so objects can be looked up by name.
+func (mfs *MinFS) encodeName(name string) string {
+	if !mfs.config.encryptNames || name == "" {
+		return name
+	}
+
+	mac := hmac.New(sha256.New, deriveKey(mfs.encryptKey, "name nonces"))
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:12]
+
+	sealed := mfs.nameAEAD.Seal(nonce, nonce, []byte(name), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// decodeName returns the name of the object name, or false if it hasn't
+// been encrypted with the key of the mount.
+func (mfs *MinFS) decodeName(name string) (string, bool) {
+	if !mfs.config.encryptNames {
+		return name, true
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(sealed) < 12+encOverhead {
+		return "", false
+	}
+
+	plain, err := mfs.nameAEAD.Open(nil, sealed[:12], sealed[12:], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plain), true
+}
+
+// encodePath returns the object path of p, encoding every element.
+func (mfs *MinFS) encodePath(p string) string {
+	if !mfs.config.encryptNames {
+		return p
+	}
+
+	elems := strings.Split(p, "/")
+	for i := range elems {
+		elems[i] = mfs.encodeName(elems[i])
+	}
+	return strings.Join(elems, "/")
+}
+
+// decodePath returns the path of the object path p.
+func (mfs *MinFS) decodePath(p string) (string, bool) {
+	if !mfs.config.encryptNames {
+		return p, true
+	}
+
+	elems := strings.Split(p, "/")
+	for i := range elems {
+		if elems[i] == "" {
+			continue
+		}
+
+		name, ok := mfs.decodeName(elems[i])
+		if !ok {
+			return "", false
+		}
+		elems[i] = name
+	}
+	return strings.Join(elems, "/"), true
+}
+
+// mountPath returns the path within the mount of the object remotePath.
+func (mfs *MinFS) mountPath(remotePath string) string {
+	if mfs.isUnion() {
+		return mfs.unionMountPath(remotePath)
+	} else if mfs.allBuckets() {
+		// bucket names aren't encrypted
+		bucket, key := mfs.splitPath(remotePath)
+		if name, ok := mfs.decodePath(key); ok {
+			return path.Join(bucket, name)
+		}
+		return remotePath
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(remotePath, mfs.config.basePath), "/")
+	if name, ok := mfs.decodePath(rel); ok {
+		return name
+	}
+	return rel
+}
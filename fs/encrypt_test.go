@@ -0,0 +1,212 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/context"
+)
+
+// newEncryptedFS returns a MinFS encrypting with a fixed key.
+func newEncryptedFS(t *testing.T, key byte) *MinFS {
+	mfs := &MinFS{config: &Config{
+		encryptKey:   bytes.Repeat([]byte{key}, 32),
+		encryptNames: true,
+	}}
+	if err := mfs.initEncryption(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+// sizes around the chunk boundaries.
+var encSizes = []int64{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 2 * encChunkSize, 3*encChunkSize - 1}
+
+func TestEncryptedSize(t *testing.T) {
+	mfs := newEncryptedFS(t, 1)
+
+	if size := encryptedSize(0); size != int64(encHeaderSize+encOverhead) {
+		t.Fatalf("Expected an empty file to be a header and an empty chunk, got %d bytes", size)
+	}
+	if size := encryptedSize(encChunkSize + 1); size != int64(encHeaderSize+encChunkSize+1+2*encOverhead) {
+		t.Fatalf("Expected a file of a chunk and a byte to be 2 chunks, got %d bytes", size)
+	}
+
+	for _, size := range encSizes {
+		if plain := mfs.plainSize(encryptedSize(size)); plain != size {
+			t.Errorf("Expected plain size %d of %d encrypted bytes, got %d", size, encryptedSize(size), plain)
+		}
+	}
+
+	if plain := mfs.plainSize(int64(encHeaderSize)); plain != 0 {
+		t.Errorf("Expected no content of a truncated object, got %d bytes", plain)
+	}
+	if plain := (&MinFS{}).plainSize(100); plain != 100 {
+		t.Errorf("Expected sizes of unencrypted objects to be unchanged, got %d", plain)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	mfs := newEncryptedFS(t, 1)
+
+	for _, size := range encSizes {
+		data := bytes.Repeat([]byte("minfs"), int(size/5+1))[:size]
+
+		r, err := mfs.newEncryptReader(bytes.NewReader(data), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		object, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(object)) != encryptedSize(size) {
+			t.Fatalf("Expected an object of %d bytes, got %d", encryptedSize(size), len(object))
+		}
+
+		r, err = mfs.newDecryptReader(bytes.NewReader(object), int64(len(object)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plain, err := ioutil.ReadAll(r); err != nil {
+			t.Fatalf("Unable to decrypt %d bytes: %v", size, err)
+		} else if !bytes.Equal(plain, data) {
+			t.Fatalf("Expected %d bytes to be decrypted unchanged", size)
+		}
+
+		// objects truncated at a chunk boundary are detected
+		if size > encChunkSize {
+			truncated := object[:encHeaderSize+encChunkSize+encOverhead]
+			r, err = mfs.newDecryptReader(bytes.NewReader(truncated), int64(len(object)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+				t.Fatalf("Expected a truncated object to fail with %v, got %v", io.ErrUnexpectedEOF, err)
+			}
+		}
+
+		// other keys fail
+		r, err = newEncryptedFS(t, 2).newDecryptReader(bytes.NewReader(object), int64(len(object)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(r); err == nil {
+			t.Fatal("Expected decrypting with an other key to fail")
+		}
+	}
+
+	if _, err := mfs.newDecryptReader(bytes.NewReader([]byte("plain text")), 10); err != errNotEncrypted {
+		t.Fatalf("Expected %v reading an unencrypted object, got %v", errNotEncrypted, err)
+	}
+}
+
+func TestEncodeName(t *testing.T) {
+	mfs := newEncryptedFS(t, 1)
+
+	for _, name := range []string{"a", "file.txt", "with space", "ünïcödé", string(bytes.Repeat([]byte("x"), 200))} {
+		encoded := mfs.encodeName(name)
+		if encoded == name {
+			t.Fatalf("Expected %s to be encrypted", name)
+		}
+		if again := mfs.encodeName(name); again != encoded {
+			t.Fatalf("Expected names to be encrypted deterministically, got %s and %s", encoded, again)
+		}
+		if decoded, ok := mfs.decodeName(encoded); !ok || decoded != name {
+			t.Fatalf("Expected %s to be decoded, got %s", name, decoded)
+		}
+		if _, ok := newEncryptedFS(t, 2).decodeName(encoded); ok {
+			t.Fatalf("Expected %s not to be decoded with an other key", name)
+		}
+	}
+
+	if _, ok := mfs.decodeName("plain"); ok {
+		t.Fatal("Expected names not encrypted with the key not to be decoded")
+	}
+
+	p := "a/b/c.txt"
+	if decoded, ok := mfs.decodePath(mfs.encodePath(p)); !ok || decoded != p {
+		t.Fatalf("Expected path %s to be decoded, got %s", p, decoded)
+	}
+}
+
+func TestEncryptionSalt(t *testing.T) {
+	var (
+		m        sync.Mutex
+		stored   []byte
+		requests int
+	)
+	mfs, cleanup := newTestFS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		requests++
+		if r.URL.Path != "/bucket/"+saltKey {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		switch {
+		case r.Method == "PUT" && stored != nil:
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case r.Method == "PUT":
+			stored, _ = ioutil.ReadAll(r.Body)
+		case r.Method == "GET" && stored == nil:
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		case r.Method == "GET":
+			w.Header().Set("ETag", `"1"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Write(stored)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer cleanup()
+	// a passphrase of 32 bytes with the newline isn't taken as a key
+	mfs.config.encryptPassphrase = []byte("passphrase of thirty-one bytes.\n")
+
+	if err := mfs.initEncryption(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != encSaltSize {
+		t.Fatalf("Expected a salt of %d bytes to be stored, got %d", encSaltSize, len(stored))
+	}
+	if key := pbkdf2.Key([]byte("passphrase of thirty-one bytes."), stored, encIterations, 32, sha256.New); !bytes.Equal(mfs.encryptKey, key) {
+		t.Fatal("Expected the key to be derived from the passphrase and the stored salt")
+	}
+
+	// the salt is kept in the cache
+	requests = 0
+	key := mfs.encryptKey
+	if err := mfs.initEncryption(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 || !bytes.Equal(mfs.encryptKey, key) {
+		t.Fatalf("Expected the cached salt to be used, got %d requests", requests)
+	}
+}
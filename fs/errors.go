@@ -0,0 +1,231 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// maximum wait between two attempts of a request.
+const maxRetryBackoff = 30 * time.Second
+
+// Transient failures are retried by s3, with backoff and offline detection.
+// The retries of the api clients would multiply the attempts, so they are
+// disabled. MaxRetry is a global of minio-go, which is safe to change as
+// the vendored copy is private to this binary and only used by MinFS.
+func init() {
+	minio.MaxRetry = 1
+}
+
+// errnos of S3 error codes.
+var s3Errnos = map[string]syscall.Errno{
+	"AccessDenied":          syscall.EACCES,
+	"AllAccessDisabled":     syscall.EACCES,
+	"InvalidAccessKeyId":    syscall.EACCES,
+	"SignatureDoesNotMatch": syscall.EACCES,
+	"ExpiredToken":          syscall.EACCES,
+	"InvalidToken":          syscall.EACCES,
+	"NoSuchKey":             syscall.ENOENT,
+	"NoSuchUpload":          syscall.ENOENT,
+	"NoSuchBucket":          syscall.ENODEV,
+	"BucketNotEmpty":        syscall.ENOTEMPTY,
+	"BucketAlreadyExists":   syscall.EEXIST,
+	"EntityTooLarge":        syscall.EFBIG,
+	"KeyTooLong":            syscall.ENAMETOOLONG,
+	"KeyTooLongError":       syscall.ENAMETOOLONG,
+	"InvalidObjectName":     syscall.EINVAL,
+	"InvalidBucketName":     syscall.EINVAL,
+	"InvalidRange":          syscall.EINVAL,
+	"InvalidObjectState":    syscall.ENODATA,
+	"PreconditionFailed":    syscall.ESTALE,
+	"MethodNotAllowed":      syscall.EPERM,
+	"NotImplemented":        syscall.ENOSYS,
+	"XMinioStorageFull":     syscall.ENOSPC,
+	"QuotaExceeded":         syscall.EDQUOT,
+	"SlowDown":              syscall.EAGAIN,
+	"Throttling":            syscall.EAGAIN,
+	"ThrottlingException":   syscall.EAGAIN,
+	"RequestLimitExceeded":  syscall.EAGAIN,
+	"RequestThrottled":      syscall.EAGAIN,
+	"ServiceUnavailable":    syscall.EAGAIN,
+	"RequestTimeout":        syscall.ETIMEDOUT,
+}
+
+// S3 error codes of transient failures.
+var transientCodes = map[string]bool{
+	"SlowDown":                   true,
+	"Throttling":                 true,
+	"ThrottlingException":        true,
+	"RequestLimitExceeded":       true,
+	"RequestThrottled":           true,
+	"ServiceUnavailable":         true,
+	"RequestTimeout":             true,
+	"InternalError":              true,
+	"XMinioServerNotInitialized": true,
+	"XMinioReadQuorum":           true,
+	"XMinioWriteQuorum":          true,
+}
+
+// syscallErrno returns the errno of a network or filesystem error.
+func syscallErrno(err error) (syscall.Errno, bool) {
+	for {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return e, true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		default:
+			return 0, false
+		}
+	}
+}
+
+// isTransient returns true if the request failing with err may succeed
+// when retried.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if e, ok := err.(*url.Error); ok {
+		return isTransientNetwork(e.Err)
+	}
+	if _, ok := err.(net.Error); ok {
+		return isTransientNetwork(err)
+	}
+	return transientCodes[minio.ToErrorResponse(err).Code]
+}
+
+// isTransientNetwork returns true if the network error err may not occur
+// again. Only timeouts, temporary failures and connections closed by the
+// server are, failed certificate verifications or unknown hosts are
+// permanent misconfigurations.
+func isTransientNetwork(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if errno, ok := syscallErrno(err); ok {
+		switch errno {
+		case syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE, syscall.ETIMEDOUT:
+			return true
+		}
+		return false
+	}
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout() || e.Temporary()
+	}
+	return false
+}
+
+// toErrno translates err into an errno which can be returned to fuse.
+func toErrno(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(fuse.ErrorNumber); ok {
+		return err
+	}
+
+	if errno, ok := s3Errnos[minio.ToErrorResponse(err).Code]; ok {
+		return fuse.Errno(errno)
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+
+	if errno, ok := syscallErrno(err); ok {
+		return fuse.Errno(errno)
+	}
+
+	return fuse.EIO
+}
+
+// backoff returns the wait before the given retry attempt, doubling
+// with every attempt, with jitter.
+func (mfs *MinFS) backoff(attempt int) time.Duration {
+	wait := mfs.config.retryBackoff << uint(attempt)
+	if wait > maxRetryBackoff || wait <= 0 {
+		wait = maxRetryBackoff
+	}
+	return wait/2 + time.Duration(mathrand.Int63n(int64(wait/2)+1))
+}
+
+// s3 calls fn, which performs S3 request api on path, retrying transient
+// failures and returning errors translated into errnos.
+func (mfs *MinFS) s3(ctx context.Context, api, path string, fn func() error) error {
+	if mfs.isOffline() {
+		return errOffline
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if ctx.Err() != nil {
+			return fuse.EINTR
+		}
+
+		t := mfs.trace(subsystemS3, api, path)
+		err = fn()
+		t.done(&err)
+
+		// failures of interrupted requests are of no interest
+		if err != nil && ctx.Err() != nil {
+			return fuse.EINTR
+		}
+
+		if !isTransient(err) || attempt >= mfs.config.retries {
+			break
+		}
+
+		wait := mfs.backoff(attempt)
+		mfs.logger(subsystemS3).WithField("op", api).WithField("path", path).
+			Warnf("Retrying after %s: %s", wait, err)
+
+		select {
+		case <-ctx.Done():
+			return fuse.EINTR
+		case <-time.After(wait):
+		}
+	}
+
+	if mfs.config.offline && isNetworkError(err) {
+		mfs.setOffline(true)
+		return errOffline
+	}
+	return toErrno(err)
+}
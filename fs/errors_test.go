@@ -0,0 +1,106 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go"
+)
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func urlError(err error) error {
+	return &url.Error{Op: "Get", URL: "http://localhost:9000/bucket", Err: err}
+}
+
+func opError(err error) error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: err}}
+}
+
+func TestIsTransient(t *testing.T) {
+	testCases := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("unknown"), false},
+		{minio.ErrorResponse{Code: "SlowDown"}, true},
+		{minio.ErrorResponse{Code: "InternalError"}, true},
+		{minio.ErrorResponse{Code: "NoSuchKey"}, false},
+		{minio.ErrorResponse{Code: "AccessDenied"}, false},
+		{timeoutError{}, true},
+		{urlError(timeoutError{}), true},
+		{urlError(io.EOF), true},
+		{urlError(opError(syscall.ECONNRESET)), true},
+		{urlError(opError(syscall.EPIPE)), true},
+		{urlError(opError(syscall.ECONNREFUSED)), false},
+		{urlError(&net.DNSError{Err: "no such host", Name: "minio.invalid", IsNotFound: true}), false},
+		{urlError(&net.DNSError{Err: "server misbehaving", Name: "minio", IsTemporary: true}), true},
+		{urlError(x509.UnknownAuthorityError{}), false},
+		{urlError(x509.HostnameError{Host: "minio"}), false},
+	}
+
+	for i, testCase := range testCases {
+		if transient := isTransient(testCase.err); transient != testCase.transient {
+			t.Errorf("Test %d: isTransient(%v) = %v, expected %v", i+1, testCase.err, transient, testCase.transient)
+		}
+	}
+}
+
+func TestToErrno(t *testing.T) {
+	testCases := []struct {
+		err   error
+		errno error
+	}{
+		{nil, nil},
+		{fuse.ENOENT, fuse.ENOENT},
+		{errOffline, errOffline},
+		{minio.ErrorResponse{Code: "NoSuchKey"}, fuse.ENOENT},
+		{minio.ErrorResponse{Code: "AccessDenied"}, fuse.Errno(syscall.EACCES)},
+		{minio.ErrorResponse{Code: "NoSuchBucket"}, fuse.Errno(syscall.ENODEV)},
+		{minio.ErrorResponse{Code: "PreconditionFailed"}, fuse.Errno(syscall.ESTALE)},
+		{minio.ErrorResponse{Code: "XMinioStorageFull"}, fuse.Errno(syscall.ENOSPC)},
+		{minio.ErrorResponse{Code: "SlowDown"}, fuse.Errno(syscall.EAGAIN)},
+		{minio.ErrorResponse{Code: "InternalError"}, fuse.EIO},
+		{urlError(timeoutError{}), fuse.Errno(syscall.ETIMEDOUT)},
+		{urlError(opError(syscall.ECONNREFUSED)), fuse.Errno(syscall.ECONNREFUSED)},
+		{&os.PathError{Op: "open", Path: "/cache/x", Err: syscall.ENOSPC}, fuse.Errno(syscall.ENOSPC)},
+		{urlError(x509.UnknownAuthorityError{}), fuse.EIO},
+		{errors.New("unknown"), fuse.EIO},
+	}
+
+	for i, testCase := range testCases {
+		if errno := toErrno(testCase.err); errno != testCase.errno {
+			t.Errorf("Test %d: toErrno(%v) = %v, expected %v", i+1, testCase.err, errno, testCase.errno)
+		}
+	}
+}
@@ -17,7 +17,6 @@
 package minfs
 
 import (
-	"crypto/sha256"
 	"io"
 	"os"
 	"path"
@@ -26,6 +25,7 @@ import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go"
 	"golang.org/x/net/context"
 )
 
@@ -57,6 +57,18 @@ type File struct {
 	Flags    uint32 // see chflags(2)
 
 	Hash []byte
+
+	// version of the object as of the time of the mount, if set.
+	VersionID string
+
+	// read-only layer of a layered union mount the object is in, 0 for
+	// the top layer.
+	Layer int
+
+	// persisted content in the cache folder, and the etag of the object
+	// it has been fetched from.
+	CachePath string
+	CacheETag string
 }
 
 func (f *File) store(tx *meta.Tx) error {
@@ -83,7 +95,23 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 }
 
 // Setattr - set attribute.
-func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	t := f.mfs.trace(subsystemFuse, "setattr", f.FullPath())
+	defer t.done(&err)
+
+	if f.mfs.readOnly() {
+		return errReadOnly
+	}
+
+	// truncate the cache file shared by open handles
+	if req.Valid.Size() {
+		if of := f.mfs.handles.lookup(f.Inode); of != nil {
+			if err := of.truncate(int64(req.Size)); err != nil {
+				return err
+			}
+		}
+	}
+
 	// update cache with new attributes
 	return f.mfs.db.Update(func(tx *meta.Tx) error {
 		if req.Valid.Mode() {
@@ -132,7 +160,7 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 
 // RemotePath will return the full path on bucket
 func (f *File) RemotePath() string {
-	return path.Join(f.dir.RemotePath(), f.Path)
+	return f.dir.mfs.layerPath(path.Join(f.dir.RemotePath(), f.dir.mfs.encodeName(f.Path)), f.Layer)
 }
 
 // FullPath will return the full path
@@ -142,7 +170,7 @@ func (f *File) FullPath() string {
 
 // Saves a new file at cached path and fetches the object based on
 // the incoming fuse request.
-func (f *File) cacheSave(path string, req *fuse.OpenRequest) error {
+func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return err
@@ -154,72 +182,162 @@ func (f *File) cacheSave(path string, req *fuse.OpenRequest) error {
 		return nil
 	}
 
-	object, err := f.mfs.api.GetObject(f.mfs.config.bucket, f.RemotePath())
-	if err != nil {
-		if meta.IsNoSuchObject(err) {
-			return fuse.ENOENT
-		}
+	reserved := int64(f.Size)
+	if err = f.mfs.reserveCache(reserved); err != nil {
 		return err
 	}
-	defer object.Close()
 
-	hasher := sha256.New()
-	size, err := io.Copy(file, io.TeeReader(object, hasher))
-	if err != nil {
+	// the object may have changed size meanwhile
+	var size int64
+	defer func() {
+		f.mfs.releaseCache(reserved - size)
+	}()
+
+	if err = f.mfs.s3(ctx, "GetObject", f.RemotePath(), func() error {
+		// start over after a failed attempt
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+
+		var (
+			object  io.ReadCloser
+			objInfo minio.ObjectInfo
+		)
+		if f.VersionID != "" {
+			object, err = f.mfs.getVersion(ctx, f.RemotePath(), f.VersionID)
+			objInfo.Size = encryptedSize(int64(f.Size))
+		} else {
+			object, objInfo, err = f.mfs.getObject(f.RemotePath())
+		}
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		r := f.mfs.downloadReader(ctx, object)
+		if f.mfs.encrypted() {
+			if r, err = f.mfs.newDecryptReader(r, objInfo.Size); err != nil {
+				return err
+			}
+		}
+
+		size, err = io.Copy(file, r)
+		f.mfs.metrics.downloaded.Add(uint64(size))
+		return err
+	}); err == errArchived && f.mfs.config.restoreDays > 0 {
+		f.requestRestore(ctx)
+		return err
+	} else if err != nil {
 		return err
 	}
 
 	// update actual file size
 	f.Size = uint64(size)
 
-	// hash will be used when encrypting files
-	_ = hasher.Sum(nil)
-
 	// Success.
 	return nil
 }
 
-// Open return a file handle of the opened file
-func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if err := f.dir.mfs.wait(f.Path); err != nil {
-		return nil, err
+// requestRestore requests a restore of the archived object of f.
+func (f *File) requestRestore(ctx context.Context) {
+	if err := f.mfs.restoreObject(ctx, f.RemotePath()); err != nil {
+		f.mfs.log.Errorf("Unable to restore %s: %s\n", f.FullPath(), err)
+	} else {
+		f.mfs.log.Printf("Restore of archived %s requested.\n", f.FullPath())
 	}
+}
 
-	// Start a writable transaction.
-	tx, err := f.mfs.db.Begin(true)
-	if err != nil {
-		return nil, err
+// keepCache records cachePath as the persisted content of f, fetched from
+// the object with etag, and removes the one it supersedes.
+func (f *File) keepCache(cachePath, etag string) {
+	if f.CachePath != "" && f.CachePath != cachePath && !f.mfs.isJournaled(f.CachePath) {
+		f.mfs.removeStaleCache(f.CachePath)
 	}
+	f.CachePath = cachePath
+	f.CacheETag = etag
+}
 
-	defer tx.Rollback()
+// Open return a file handle of the opened file
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	t := f.mfs.trace(subsystemFuse, "open", f.FullPath())
+	defer t.done(&err)
 
-	cachePath, err := f.dir.mfs.NewCachePath()
-	if err != nil {
-		return nil, err
+	if f.mfs.isDraining() {
+		return nil, errShuttingDown
 	}
 
-	err = f.cacheSave(cachePath, req)
-	if err != nil {
-		return nil, err
+	if f.mfs.readOnly() && !req.Flags.IsReadOnly() {
+		return nil, errReadOnly
 	}
 
-	fh, err := f.mfs.Acquire(f)
+	truncate := req.Flags&fuse.OpenTruncate == fuse.OpenTruncate
+
+	fh, err := f.mfs.Acquire(f, !req.Flags.IsReadOnly(), func() (*openFile, error) {
+		cachePath, cached := f.cachedContent()
+		f.mfs.metrics.cacheHit("content", cached)
+		if !cached && f.appendOnly(req) {
+			return f.openAppend()
+		} else if !cached && f.lazy(req) {
+			return f.openSparse(ctx)
+		} else if !cached {
+			if cachePath, err = f.dir.mfs.NewCachePath(); err != nil {
+				return nil, err
+			}
+
+			if err = f.cacheSave(ctx, cachePath, req); err != nil {
+				f.mfs.removeCacheFile(cachePath)
+				return nil, err
+			}
+
+			if f.mfs.persistCache() {
+				f.keepCache(cachePath, f.ETag)
+			}
+		}
+		return openCacheFile(f, cachePath, 0)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	fh.cachePath = cachePath
+	t.handle = fh.handle
 
-	fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags), f.mfs.config.mode)
-	if err != nil {
-		return nil, err
+	// the handle is removed again if the open fails from here on
+	defer func() {
+		if err != nil {
+			f.mfs.abort(fh)
+		}
+	}()
+
+	// the open file is locked before the metadata is, as by flushes
+	if fh.writable {
+		if err = fh.of.acquireLease(ctx); err != nil {
+			return nil, err
+		}
 	}
 
-	if err = f.store(tx); err != nil {
-		return nil, err
+	if truncate {
+		if err = fh.of.resize(0); err != nil {
+			return nil, err
+		}
+		if fh.of.isDirty() {
+			if err = fh.of.setDirty(); err != nil {
+				return nil, err
+			}
+		}
+		f.Size = 0
 	}
 
-	if err = tx.Commit(); err != nil {
+	if err = f.mfs.db.Update(func(tx *meta.Tx) error {
+		if f.mfs.persistCache() && !fh.of.partial() {
+			if err := f.mfs.touchCache(tx, fh.of.cachePath, int64(f.Size)); err != nil {
+				return err
+			}
+		}
+		return f.store(tx)
+	}); err != nil {
 		return nil, err
 	}
 
@@ -233,7 +351,10 @@ func (f *File) bucket(tx *meta.Tx) *meta.Bucket {
 }
 
 // Getattr returns the file attributes
-func (f *File) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+func (f *File) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) (err error) {
+	t := f.mfs.trace(subsystemFuse, "getattr", f.FullPath())
+	defer t.done(&err)
+
 	resp.Attr = fuse.Attr{
 		Inode:  f.Inode,
 		Size:   f.Size,
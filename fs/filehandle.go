@@ -18,9 +18,6 @@ package minfs
 
 import (
 	"io"
-	"os"
-
-	"github.com/minio/minfs/meta"
 
 	"bazil.org/fuse"
 	"golang.org/x/net/context"
@@ -28,24 +25,25 @@ import (
 
 // FileHandle - Contains an opened file which can be read from and written to
 type FileHandle struct {
-	// the os file handle
-	*os.File
+	// the open file, shared with all handles of the same file
+	of *openFile
 
 	// the fuse file
 	f *File
 
-	// cache file has been written to
-	dirty bool
-
-	cachePath string
+	// handle was opened for writing
+	writable bool
 
 	handle uint64
 }
 
 // Read from the file handle
-func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	t := fh.trace("read")
+	defer t.done(&err)
+
 	buff := make([]byte, req.Size)
-	n, err := fh.File.ReadAt(buff, req.Offset)
+	n, err := fh.of.readAt(buff, req.Offset)
 	if err != nil && err != io.EOF {
 		return err
 	}
@@ -54,11 +52,15 @@ func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 }
 
 // Write to the file handle
-func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	if _, err := fh.File.Seek(req.Offset, 0); err != nil {
+func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	t := fh.trace("write")
+	defer t.done(&err)
+
+	if err = fh.of.reserve(req.Offset + int64(len(req.Data))); err != nil {
 		return err
 	}
-	n, err := fh.File.Write(req.Data)
+
+	n, err := fh.of.writeAt(req.Data, req.Offset)
 	if err != nil {
 		return err
 	}
@@ -69,8 +71,7 @@ func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *f
 		fh.f.Size = uint64(req.Offset) + uint64(n)
 	}
 	resp.Size = n
-	fh.dirty = true
-	return nil
+	return fh.of.markDirty()
 }
 
 // Fsync because of bug in fuse lib, this is on file. -- FIXME - needs more context (y4m4).
@@ -79,43 +80,118 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	return nil
 }
 
-// Release the file handle
-func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	if err := fh.Close(); err != nil {
-		return err
+// Release the file handle, the file is uploaded when its last writer is
+// released and closed when its last handle is released.
+func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	t := fh.trace("release")
+	defer t.done(&err)
+
+	mfs := fh.f.mfs
+
+	// flock locks are released with the file, and no lock survives the
+	// handle it has been acquired through.
+	mfs.fileLocks.release(fh.f.Inode, func(l byteLock) bool {
+		if l.flock && req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 && l.owner == req.LockOwner {
+			return true
+		}
+		return l.handle == fh.handle
+	})
+
+	// the last writer may be released without a preceding flush of its
+	// own, when an other writer has been flushed first.
+	if mfs.handles.isLastWriter(fh) {
+		if err = fh.of.flush(mfs.ctx); err != nil {
+			mfs.log.Errorf("Unable to flush %s: %s\n", fh.f.FullPath(), err)
+		}
+		fh.of.releaseLease(mfs.ctx)
 	}
 
-	defer fh.f.mfs.Release(fh)
-
-	os.Remove(fh.cachePath)
-	return nil
+	if rerr := mfs.Release(fh); rerr != nil {
+		return rerr
+	}
+	return err
 }
 
-// Flush - experimenting with uploading at flush, this slows operations down till it has been
-// completely flushed
-func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	if !fh.dirty {
+// Flush uploads the file when the handle is its last writer, this slows
+// operations down till it has been completely flushed
+func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	t := fh.trace("flush")
+	defer t.done(&err)
+
+	// closing any descriptor of the file releases the fcntl locks of the
+	// process.
+	fh.f.mfs.fileLocks.release(fh.f.Inode, func(l byteLock) bool {
+		return !l.flock && l.owner == req.LockOwner
+	})
+
+	if !fh.f.mfs.handles.isLastWriter(fh) {
 		return nil
 	}
+	return fh.of.flush(fh.f.mfs.ctx)
+}
 
-	sr := newPutOp(fh.Name(), fh.f.RemotePath(), int64(fh.f.Size))
-	if err := fh.f.mfs.sync(&sr); err != nil {
-		return err
+// byteLock returns the lock requested by req.
+func (fh *FileHandle) byteLock(req *fuse.LockRequest) byteLock {
+	return byteLock{
+		owner:  req.LockOwner,
+		handle: fh.handle,
+		pid:    req.Lock.PID,
+		flock:  req.LockFlags&fuse.LockFlock != 0,
+		typ:    req.Lock.Type,
+		start:  req.Lock.Start,
+		end:    req.Lock.End,
 	}
+}
 
-	// we'll wait for the request to be uploaded and synced, before
-	// releasing the file
-	if err := <-sr.Error; err != nil {
-		return err
-	}
+// Lock tries to acquire a fcntl or flock lock on the file.
+func (fh *FileHandle) Lock(ctx context.Context, req *fuse.LockRequest) (err error) {
+	t := fh.trace("lock")
+	defer t.done(&err)
 
-	// update cache
-	if err := fh.f.mfs.db.Update(func(tx *meta.Tx) error {
-		return fh.f.store(tx)
-	}); err != nil {
-		return err
+	return fh.f.mfs.fileLocks.lock(ctx, fh.f.Inode, fh.byteLock(req), false)
+}
+
+// LockWait acquires a fcntl or flock lock on the file, waiting for
+// conflicting locks to be released.
+func (fh *FileHandle) LockWait(ctx context.Context, req *fuse.LockWaitRequest) (err error) {
+	t := fh.trace("lockwait")
+	defer t.done(&err)
+
+	return fh.f.mfs.fileLocks.lock(ctx, fh.f.Inode, fh.byteLock(&req.LockRequest), true)
+}
+
+// Unlock releases a fcntl or flock lock on the file.
+func (fh *FileHandle) Unlock(ctx context.Context, req *fuse.UnlockRequest) (err error) {
+	t := fh.trace("unlock")
+	defer t.done(&err)
+
+	fh.f.mfs.fileLocks.unlock(fh.f.Inode, fh.byteLock(&req.LockRequest))
+	return nil
+}
+
+// QueryLock returns a lock conflicting with the requested one.
+func (fh *FileHandle) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) (err error) {
+	t := fh.trace("querylock")
+	defer t.done(&err)
+
+	l, ok := fh.f.mfs.fileLocks.query(fh.f.Inode, fh.byteLock(&req.LockRequest))
+	if !ok {
+		resp.Lock = fuse.FileLock{Type: fuse.LockUnlock}
+		return nil
 	}
 
-	fh.dirty = false
+	resp.Lock = fuse.FileLock{
+		Start: l.start,
+		End:   l.end,
+		Type:  l.typ,
+		PID:   l.pid,
+	}
 	return nil
 }
+
+// trace starts tracking fuse operation op on the handle.
+func (fh *FileHandle) trace(op string) *trace {
+	t := fh.f.mfs.trace(subsystemFuse, op, fh.f.FullPath())
+	t.handle = fh.handle
+	return t
+}
@@ -18,21 +18,25 @@
 package minfs
 
 import (
-	"crypto/tls"
+	"crypto/cipher"
+	"encoding/xml"
 	"fmt"
-	"log"
-	"mime"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
-	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/Sirupsen/logrus"
+
 	"github.com/minio/minfs/meta"
 	"github.com/minio/minio-go"
 	"github.com/minio/minio-go/pkg/credentials"
@@ -51,20 +55,66 @@ type MinFS struct {
 	config *Config
 	api    *minio.Client
 
+	// api clients of the sources of union mounts, by name.
+	clients map[string]*minio.Client
+
+	// transport of the api client, used for requests made directly.
+	transport *reloadTransport
+
+	// identifies this instance in lease objects.
+	holderID string
+
+	// client side encryption key, nil if disabled.
+	encryptKey []byte
+	// cipher of encrypted object names.
+	nameAEAD cipher.AEAD
+
 	db *meta.DB
 
 	// Logger instance.
-	log *log.Logger
+	log *logrus.Logger
 
-	// contains all open handles
-	handles []*FileHandle
+	// log file, reopened on SIGHUP.
+	logW *rotatingWriter
 
-	locks map[string]bool
+	// contains all open handles
+	handles *handleTable
 
-	m sync.Mutex
+	// fcntl and flock locks
+	fileLocks *lockManager
 
 	syncChan chan interface{}
 
+	// number of sync operations queued or in progress.
+	queued int64
+
+	metrics *metricSet
+
+	// bandwidth limits of uploads and downloads.
+	throttle *throttle
+
+	// limits the read-ahead windows fetched at once.
+	readAhead chan struct{}
+
+	// bytes used by the cache files, when bounded. Updated as cache
+	// files are reserved, resized and removed.
+	cacheUsed int64
+	// serializes eviction passes.
+	evictM sync.Mutex
+
+	// set while the server is unreachable in offline mode.
+	offline int32
+
+	// cancelled once the shutdown timeout is exceeded, interrupting
+	// uploads in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// set once shutdown has started.
+	draining     int32
+	shutdownOnce sync.Once
+	shutdownErr  error
+
 	listenerDoneCh chan struct{}
 }
 
@@ -76,12 +126,6 @@ func New(options ...func(*Config)) (*MinFS, error) {
 		return nil, err
 	}
 
-	// Initialize log file.
-	logW, err := os.OpenFile(globalLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
-		return nil, err
-	}
-
 	// Set defaults
 	cfg := &Config{
 		cache:     globalDBDir,
@@ -92,6 +136,24 @@ func New(options ...func(*Config)) (*MinFS, error) {
 		accessKey: ac.AccessKey,
 		secretKey: ac.SecretKey,
 		mode:      os.FileMode(0660),
+
+		shutdownTimeout: 30 * time.Second,
+		recoverPolicy:   RecoverUpload,
+		probeInterval:   30 * time.Second,
+
+		retries:      3,
+		retryBackoff: time.Second,
+
+		renameWorkers:    8,
+		readAheadWorkers: 4,
+		shareExpiry:      24 * time.Hour,
+
+		debug:         map[string]bool{},
+		logFile:       globalLogFile,
+		logFormat:     "logfmt",
+		logLevel:      logrus.InfoLevel,
+		logMaxSize:    100 << 20,
+		logMaxBackups: 5,
 	}
 
 	for _, optionFn := range options {
@@ -102,36 +164,54 @@ func New(options ...func(*Config)) (*MinFS, error) {
 		return nil, err
 	}
 
+	// Initialize log file.
+	logger, logW, err := newLogger(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize MinFS.
 	fs := &MinFS{
 		config:         cfg,
 		syncChan:       make(chan interface{}),
-		locks:          map[string]bool{},
-		log:            log.New(logW, "MinFS ", log.Ldate|log.Ltime|log.Lshortfile),
+		handles:        newHandleTable(),
+		fileLocks:      newLockManager(),
+		holderID:       newHolderID(),
+		log:            logger,
+		logW:           logW,
 		listenerDoneCh: make(chan struct{}),
 	}
+	fs.ctx, fs.cancel = context.WithCancel(context.Background())
+	fs.metrics = newMetrics(fs)
+	fs.throttle = newThrottle(cfg)
+	fs.readAhead = make(chan struct{}, cfg.readAheadWorkers)
 
 	// Success..
 	return fs, nil
 }
 
 func (mfs *MinFS) mount() (*fuse.Conn, error) {
-	return fuse.Mount(
-		mfs.config.mountpoint,
+	options := []fuse.MountOption{
 		fuse.FSName("MinFS"),
 		fuse.Subtype("MinFS"),
 		fuse.LocalVolume(),
-		fuse.VolumeName(mfs.config.bucket),
+		fuse.VolumeName(mfs.volumeName()),
 		fuse.AllowOther(),
 		fuse.DefaultPermissions(),
-	)
+		fuse.LockingPOSIX(),
+		fuse.LockingFlock(),
+	}
+	if mfs.readOnly() {
+		options = append(options, fuse.ReadOnly())
+	}
+	return fuse.Mount(mfs.config.mountpoint, options...)
 }
 
 // Serve starts the MinFS client
 func (mfs *MinFS) Serve() (err error) {
-	if mfs.config.debug {
+	if mfs.debugEnabled(subsystemFuse) {
 		fuse.Debug = func(msg interface{}) {
-			mfs.log.Printf("%#v\n", msg)
+			mfs.logger(subsystemFuse).Debugln(msg)
 		}
 	}
 
@@ -157,17 +237,44 @@ func (mfs *MinFS) Serve() (err error) {
 		mfs.shutdown()
 	}()
 
+	// reload on SIGHUP
+	hupCh := signalNotify(syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	go func() {
+		for range hupCh {
+			mfs.reload()
+		}
+	}()
+
 	// Initialize database.
 	mfs.log.Println("Opening cache database...")
-	mfs.db, err = meta.Open(path.Join(mfs.config.cache, "cache.db"), 0600, nil)
+	mfs.db, err = meta.Open(mfs.dbPath(), 0600, nil)
 	if err != nil {
 		return err
 	}
 	defer mfs.db.Close()
 
+	mfs.db.OnTx = mfs.metrics.observeTx
+
 	mfs.log.Println("Initializing cache database...")
 	if err = mfs.db.Update(func(tx *meta.Tx) error {
-		_, berr := tx.CreateBucketIfNotExists([]byte("minio/"))
+		if _, berr := tx.CreateBucketIfNotExists([]byte("dirty/")); berr != nil {
+			return berr
+		}
+		if _, berr := tx.CreateBucketIfNotExists([]byte("journal/")); berr != nil {
+			return berr
+		}
+		if _, berr := tx.CreateBucketIfNotExists([]byte("cache/")); berr != nil {
+			return berr
+		}
+		if _, berr := tx.CreateBucketIfNotExists([]byte("renames/")); berr != nil {
+			return berr
+		}
+		if _, berr := tx.CreateBucketIfNotExists([]byte("keys/")); berr != nil {
+			return berr
+		}
+		_, berr := tx.CreateBucketIfNotExists([]byte(mfs.namespace()))
 		return berr
 	}); err != nil {
 		return err
@@ -189,38 +296,46 @@ func (mfs *MinFS) Serve() (err error) {
 		return err
 	}
 
-	var transport http.RoundTripper = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: mfs.config.insecure,
-		},
-		// Set this value so that the underlying transport round-tripper
-		// doesn't try to auto decode the body of objects with
-		// content-encoding set to `gzip`.
-		//
-		// Refer:
-		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
-		DisableCompression: true,
-	}
-
-	mfs.api.SetCustomTransport(transport)
+	transport, err := mfs.newTransport()
+	if err != nil {
+		return err
+	}
+
+	mfs.transport = &reloadTransport{}
+	mfs.transport.store(transport)
+	mfs.api.SetCustomTransport(mfs.transport)
 
 	// Validate if the bucket is valid and accessible.
-	exists, err := mfs.api.BucketExists(mfs.config.bucket)
-	if err != nil {
+	var exists bool
+	if mfs.isUnion() {
+		if err = mfs.initSources(); err != nil {
+			return err
+		}
+		exists = true
+	} else if mfs.allBuckets() {
+		mfs.log.Println("Bucket not set... mounting all buckets")
+		exists = true
+	} else if err = mfs.s3(context.Background(), "BucketExists", "", func() (berr error) {
+		exists, berr = mfs.api.BucketExists(mfs.config.bucket)
+		return berr
+	}); err == errOffline {
+		// serve from the cache until the server is reachable
+		exists = true
+	} else if err != nil {
 		return err
 	}
 	if !exists {
 		mfs.log.Println("Bucket doesn't not exist... attempting to create")
-		if err = mfs.api.MakeBucket(mfs.config.bucket, ""); err != nil {
+		if err = mfs.s3(context.Background(), "MakeBucket", "", func() error {
+			return mfs.api.MakeBucket(mfs.config.bucket, "")
+		}); err != nil {
+			return err
+		}
+	}
+
+	if mfs.config.encryptKey != nil || mfs.config.encryptPassphrase != nil {
+		mfs.log.Println("Initializing encryption keys...")
+		if err = mfs.initEncryption(context.Background()); err != nil {
 			return err
 		}
 	}
@@ -231,10 +346,68 @@ func (mfs *MinFS) Serve() (err error) {
 	//	return err
 	//	}
 
+	if mfs.readOnly() {
+		mfs.log.Printf("Mounting read-only as of %s.\n", mfs.config.asOf.Format(time.RFC3339))
+	} else {
+		mfs.log.Println("Recovering dirty cache files...")
+		if err = mfs.recover(); err != nil {
+			return err
+		}
+
+		mfs.log.Println("Resuming interrupted renames...")
+		if err = mfs.resumeRenames(); err != nil {
+			return err
+		}
+	}
+
 	if err = mfs.startSync(); err != nil {
 		return err
 	}
 
+	if mfs.cacheLimited() {
+		mfs.log.Println("Starting cache eviction...")
+		evictDoneCh := make(chan struct{})
+		defer close(evictDoneCh)
+		if err = mfs.startEviction(evictDoneCh); err != nil {
+			return err
+		}
+	}
+
+	if len(mfs.config.rateSchedule) > 0 {
+		scheduleDoneCh := make(chan struct{})
+		defer close(scheduleDoneCh)
+		mfs.startSchedule(scheduleDoneCh)
+	}
+
+	if mfs.config.offline {
+		mfs.log.Println("Starting connectivity probe...")
+		probeDoneCh := make(chan struct{})
+		defer close(probeDoneCh)
+		mfs.startProbe(probeDoneCh)
+
+		if !mfs.isOffline() && !mfs.readOnly() {
+			if err = mfs.replayJournal(); err != nil && err != errOffline {
+				return err
+			}
+		}
+	}
+
+	mfs.log.Println("Starting control socket...")
+	control, err := mfs.startControl()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	if mfs.config.metrics != "" {
+		mfs.log.Println("Starting metrics listener...")
+		var l net.Listener
+		if l, err = mfs.startMetrics(); err != nil {
+			return err
+		}
+		defer l.Close()
+	}
+
 	mfs.log.Println("Serving... Have fun!")
 	// Serve the filesystem
 	if err = fs.Serve(c, mfs); err != nil {
@@ -246,81 +419,239 @@ func (mfs *MinFS) Serve() (err error) {
 	return c.MountError
 }
 
-func (mfs *MinFS) shutdown() {
-	fuse.Unmount(mfs.config.mountpoint)
-	mfs.log.Println("MinFS stopped cleanly.")
+// reload reopens the log file and rereads the certificates.
+func (mfs *MinFS) reload() {
+	if err := mfs.logW.Reopen(); err != nil {
+		mfs.log.Errorln("Unable to reopen log file.", err)
+	} else {
+		mfs.log.Println("Reopened log file.")
+	}
+
+	mfs.reloadCerts()
 }
 
-func (mfs *MinFS) sync(req interface{}) error {
-	mfs.syncChan <- req
-	return nil
+// sync queues req for the sync worker, failing if ctx is done first.
+func (mfs *MinFS) sync(ctx context.Context, req interface{}) error {
+	atomic.AddInt64(&mfs.queued, 1)
+	select {
+	case mfs.syncChan <- req:
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt64(&mfs.queued, -1)
+		return fuse.EINTR
+	}
 }
 
-func (mfs *MinFS) moveOp(req *MoveOperation) {
-	src := minio.NewSourceInfo(mfs.config.bucket, req.Source, nil)
-	dst, err := minio.NewDestinationInfo(mfs.config.bucket, req.Target, nil, nil)
-	if err != nil {
-		req.Error <- err
-		return
+func (mfs *MinFS) moveOp(req *MoveOperation) error {
+	if err := mfs.copyObject(req.Source, req.Target); err != nil {
+		return err
 	}
-	if err = mfs.api.CopyObject(dst, src); err != nil {
-		req.Error <- err
-		return
+	return mfs.removeObject(req.Source)
+}
+
+func (mfs *MinFS) copyOp(req *CopyOperation) error {
+	return mfs.copyObject(req.Source, req.Target)
+}
+
+// copyHeaders returns the headers of a copy of the object of objInfo to
+// target.
+func (mfs *MinFS) copyHeaders(target string, objInfo minio.ObjectInfo) http.Header {
+	header := http.Header{}
+	for k, v := range mfs.objectHeaders(target) {
+		header.Set(k, v)
 	}
-	if err = mfs.api.RemoveObject(mfs.config.bucket, req.Source); err != nil {
-		req.Error <- err
-		return
+
+	// copies are stored in the default class, unless set
+	if class := objInfo.Metadata.Get(storageClassHeader); header.Get(storageClassHeader) == "" && class != "" {
+		header.Set(storageClassHeader, class)
+	}
+	return header
+}
+
+// copyUserMetadata adds the user metadata of the object of objInfo to
+// header.
+func copyUserMetadata(header http.Header, objInfo minio.ObjectInfo) {
+	for k, v := range objInfo.Metadata {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") && len(v) > 0 {
+			header.Set(k, v[0])
+		}
 	}
-	req.Error <- nil
 }
 
-func (mfs *MinFS) copyOp(req *CopyOperation) {
-	src := minio.NewSourceInfo(mfs.config.bucket, req.Source, nil)
-	dst, err := minio.NewDestinationInfo(mfs.config.bucket, req.Target, nil, nil)
+func (mfs *MinFS) copyObject(source, target string) error {
+	ctx := context.Background()
+	objInfo, err := mfs.statObject(ctx, source)
 	if err != nil {
-		req.Error <- err
-		return
+		return err
+	}
+
+	// the content type is kept, unless a rule sets an other one.
+	contentType := objInfo.ContentType
+	if override := mfs.typeOverride(target); override != "" && !mfs.encrypted() {
+		contentType = override
+	}
+
+	// Copies in parts and changes of the content type replace the
+	// metadata, which is copied over.
+	header := mfs.copyHeaders(target, objInfo)
+	if objInfo.Size > maxCopySize || contentType != objInfo.ContentType {
+		header.Set("Content-Type", contentType)
+		copyUserMetadata(header, objInfo)
+	}
+
+	if objInfo.Size > maxCopySize {
+		srcs := []composeSource{{path: source, size: objInfo.Size, etag: objInfo.ETag}}
+		return mfs.s3(ctx, "ComposeObject", target, func() error {
+			return mfs.composeObject(ctx, target, header, srcs)
+		})
+	}
+
+	if contentType != objInfo.ContentType {
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	}
+	return mfs.s3(ctx, "CopyObject", target, func() error {
+		return mfs.copyRequest(ctx, source, target, header)
+	})
+}
+
+func (mfs *MinFS) removeObject(target string) error {
+	return mfs.s3(context.Background(), "RemoveObject", target, func() error {
+		bucket, key := mfs.splitPath(target)
+		return mfs.client(target).RemoveObject(bucket, key)
+	})
+}
+
+// responseError returns the error of the failed request of resp.
+func responseError(resp *http.Response) error {
+	errResp := minio.ErrorResponse{}
+	if err := xml.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return errResp
+}
+
+// listObjects calls fn for every object below prefix. The listing starts
+// over on transient failures, errors returned by fn abort it.
+func (mfs *MinFS) listObjects(ctx context.Context, prefix string, recursive bool, fn func(minio.ObjectInfo) error) error {
+	var ferr error
+	if err := mfs.s3(ctx, "ListObjectsV2", prefix, func() error {
+		// The channel will abort the ListObjectsV2 request.
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+
+		root, _ := mfs.splitRoot(prefix)
+		bucket, keyPrefix := mfs.splitPath(prefix)
+		ch := mfs.client(prefix).ListObjectsV2(bucket, keyPrefix, recursive, doneCh)
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case objInfo, ok := <-ch:
+				if !ok {
+					return nil
+				}
+				if objInfo.Err != nil {
+					return objInfo.Err
+				}
+				objInfo.Key = mfs.joinPath(root, objInfo.Key)
+				if ferr = fn(objInfo); ferr != nil {
+					return nil
+				}
+			}
+		}
+	}); err != nil {
+		return err
 	}
-	if err = mfs.api.CopyObject(dst, src); err != nil {
-		req.Error <- err
-		return
+
+	if ctx.Err() != nil {
+		return fuse.EINTR
 	}
-	req.Error <- nil
+	return ferr
+}
+
+// interruptOnDone closes c once ctx is done, until the returned function
+// is called. Closing the file being uploaded interrupts the upload.
+func interruptOnDone(ctx context.Context, c io.Closer) func() {
+	stopCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopCh:
+		}
+	}()
+	return func() { close(stopCh) }
 }
 
-func (mfs *MinFS) putOp(req *PutOperation) {
+func (mfs *MinFS) putOp(req *PutOperation) error {
+	ctx := req.ctx
+
 	r, err := os.Open(req.Source)
 	if err != nil {
-		req.Error <- err
-		return
+		return err
 	}
 	defer r.Close()
+	defer interruptOnDone(ctx, r)()
+
+	contentType := mfs.contentType(req.Source, req.Target)
+	length := req.Length
+	if mfs.encrypted() {
+		// the type would reveal the content
+		contentType = "application/octet-stream"
+		length = encryptedSize(req.Length)
+	}
+
+	if err = mfs.s3(ctx, "PutObject", req.Target, func() error {
+		// start over after a failed attempt
+		if _, serr := r.Seek(0, 0); serr != nil {
+			return serr
+		}
 
-	ops := &minio.PutObjectOptions{
-		ContentType: mime.TypeByExtension(filepath.Ext(req.Target)),
+		var body io.Reader = r
+		if mfs.encrypted() {
+			var eerr error
+			if body, eerr = mfs.newEncryptReader(r, req.Length); eerr != nil {
+				return eerr
+			}
+		}
+
+		n, perr := mfs.putObject(ctx, req.Target, mfs.uploadReader(ctx, body), length, contentType, mfs.objectHeaders(req.Target))
+		mfs.metrics.uploaded.Add(uint64(n))
+		return perr
+	}); err != nil {
+		return err
 	}
-	_, err = mfs.api.PutObject(mfs.config.bucket, req.Target, r, req.Length, ops)
+
+	// PutObject doesn't return the etag of the new object.
+	objInfo, err := mfs.statObject(ctx, req.Target)
 	if err != nil {
-		req.Error <- err
-		return
+		return err
 	}
+	req.ETag = objInfo.ETag
 	mfs.log.Printf("Upload finished: %s -> %s.\n", req.Source, req.Target)
-	req.Error <- nil
+	return nil
 }
 
 func (mfs *MinFS) startSync() error {
 	go func() {
 		for req := range mfs.syncChan {
+			if mfs.debugEnabled(subsystemSync) {
+				mfs.logger(subsystemSync).WithField("queued", atomic.LoadInt64(&mfs.queued)).Debugf("Processing %T.", req)
+			}
+
 			switch req := req.(type) {
+			case *AppendOperation:
+				req.Error <- mfs.appendOp(req)
 			case *MoveOperation:
-				mfs.moveOp(req)
+				req.Error <- mfs.moveOp(req)
 			case *CopyOperation:
-				mfs.copyOp(req)
+				req.Error <- mfs.copyOp(req)
 			case *PutOperation:
-				mfs.putOp(req)
+				req.Error <- mfs.putOp(req)
 			default:
 				panic("Unknown type")
 			}
+			atomic.AddInt64(&mfs.queued, -1)
 		}
 	}()
 	return nil
@@ -336,35 +667,56 @@ func (mfs *MinFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fus
 	return nil
 }
 
-// Acquire will return a new FileHandle
-func (mfs *MinFS) Acquire(f *File) (*FileHandle, error) {
-	if err := mfs.Lock(f.FullPath()); err != nil {
-		return nil, err
+// Acquire returns a new handle of f, sharing the cache file of f if it
+// is already open, otherwise open is called to open it.
+func (mfs *MinFS) Acquire(f *File, writable bool, open func() (*openFile, error)) (*FileHandle, error) {
+	if fh := mfs.handles.share(f, writable); fh != nil {
+		return fh, nil
 	}
 
-	h := &FileHandle{
-		f: f,
+	of, err := open()
+	if err != nil {
+		return nil, err
 	}
 
-	mfs.handles = append(mfs.handles, h)
-
-	h.handle = uint64(len(mfs.handles) - 1)
-	return h, nil
+	fh, ok := mfs.handles.register(f, of, writable)
+	if !ok {
+		// opened concurrently, use the other cache file
+		of.Close()
+		if of.cachePath != fh.of.cachePath {
+			mfs.removeCache(of.cachePath)
+		}
+	}
+	return fh, nil
 }
 
-// Release release the filehandle
+// Release removes fh, and closes its file if it was the last handle.
 func (mfs *MinFS) Release(fh *FileHandle) error {
-	if err := mfs.Unlock(fh.f.FullPath()); err != nil {
-		return err
+	if !mfs.handles.release(fh) {
+		return nil
 	}
+	return fh.of.close()
+}
 
-	mfs.handles[fh.handle] = nil
-	return nil
+// abort removes fh after a failed open. Returns true if its file has been
+// closed.
+func (mfs *MinFS) abort(fh *FileHandle) bool {
+	// the lease is released with the last writer
+	if mfs.handles.isLastWriter(fh) {
+		fh.of.releaseLease(mfs.ctx)
+	}
+
+	if !mfs.handles.release(fh) {
+		return false
+	}
+
+	fh.of.Close()
+	return true
 }
 
 // NextSequence will return the next free iNode
 func (mfs *MinFS) NextSequence(tx *meta.Tx) (sequence uint64, err error) {
-	bucket := tx.Bucket("minio/")
+	bucket := tx.Bucket(mfs.namespace())
 	return bucket.NextSequence()
 }
 
@@ -386,6 +738,11 @@ type Storer interface {
 	store(tx *meta.Tx)
 }
 
+// dbPath returns the path of the metadata database in the cache folder.
+func (mfs *MinFS) dbPath() string {
+	return path.Join(mfs.config.cache, "cache.db")
+}
+
 // NewCachePath -
 func (mfs *MinFS) NewCachePath() (string, error) {
 	cachePath := path.Join(mfs.config.cache, nextSuffix())
@@ -22,4 +22,5 @@ const (
 	globalConfigFile = "/etc/minfs/config.json"
 	globalDBDir      = "/etc/minfs/db"
 	globalLogFile    = "/var/log/minfs.log"
+	globalSocketDir  = "/var/run/minfs"
 )
@@ -0,0 +1,623 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/minio/minfs/meta"
+	"golang.org/x/net/context"
+)
+
+// openFile is the state shared by all handles of the same file.
+type openFile struct {
+	// the shared cache file
+	*os.File
+
+	cachePath string
+
+	// the file as it was opened first, used for uploads
+	f *File
+
+	// number of handles, and of handles opened for writing, guarded
+	// by the handle table.
+	handles int
+	writers int
+
+	// serializes flushes and dirty tracking
+	m sync.Mutex
+
+	// cache file has been written to, set with m held. Accessed
+	// atomically, so it can be read during a flush.
+	dirty int32
+
+	// lease held while the file is open for writing
+	lease *leaseHolder
+
+	// bytes at the start of the file only in the object while appending
+	// to a file not fetched, the cache file holds the bytes after them.
+	// Of those, appended bytes have been appended to the object already.
+	base     int64
+	appended int64
+
+	// guards base and appended, held for reading while accessing the
+	// cache file.
+	baseM sync.RWMutex
+
+	// blocks fetched of a cache file opened before its content has been
+	// downloaded, nil if it has been downloaded on open.
+	sparse *sparseFile
+}
+
+// openCacheFile opens the cache file at cachePath as the open file of f.
+func openCacheFile(f *File, cachePath string, flags int) (*openFile, error) {
+	file, err := os.OpenFile(cachePath, os.O_RDWR|flags, f.mfs.config.mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openFile{
+		File:      file,
+		cachePath: cachePath,
+		f:         f,
+	}, nil
+}
+
+// handleTable keeps track of all open handles and the files they share.
+type handleTable struct {
+	m sync.Mutex
+
+	// handles by handle id
+	handles map[uint64]*FileHandle
+	// open files by inode
+	files map[uint64]*openFile
+
+	// handle ids released for reuse
+	free []uint64
+	next uint64
+}
+
+func newHandleTable() *handleTable {
+	return &handleTable{
+		handles: map[uint64]*FileHandle{},
+		files:   map[uint64]*openFile{},
+	}
+}
+
+// newHandle returns a handle of of with a free handle id, called with
+// ht.m held.
+func (ht *handleTable) newHandle(f *File, of *openFile, writable bool) *FileHandle {
+	var id uint64
+	if n := len(ht.free); n > 0 {
+		id = ht.free[n-1]
+		ht.free = ht.free[:n-1]
+	} else {
+		id = ht.next
+		ht.next++
+	}
+
+	of.handles++
+	if writable {
+		of.writers++
+	}
+
+	fh := &FileHandle{
+		of:       of,
+		f:        f,
+		writable: writable,
+		handle:   id,
+	}
+	ht.handles[id] = fh
+	return fh
+}
+
+// share returns a new handle of f if f is already open, sharing its
+// cache file.
+func (ht *handleTable) share(f *File, writable bool) *FileHandle {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	of, ok := ht.files[f.Inode]
+	if !ok {
+		return nil
+	}
+	return ht.newHandle(f, of, writable)
+}
+
+// register returns a new handle of f with of as its open file. If f has
+// been opened meanwhile, the handle shares that one instead and of is
+// discarded, in which case false is returned.
+func (ht *handleTable) register(f *File, of *openFile, writable bool) (*FileHandle, bool) {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	if existing, ok := ht.files[f.Inode]; ok {
+		return ht.newHandle(f, existing, writable), false
+	}
+
+	ht.files[f.Inode] = of
+	return ht.newHandle(f, of, writable), true
+}
+
+// release removes fh from the table, and returns true if it was the
+// last handle of its file.
+func (ht *handleTable) release(fh *FileHandle) bool {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	delete(ht.handles, fh.handle)
+	ht.free = append(ht.free, fh.handle)
+
+	fh.of.handles--
+	if fh.writable {
+		fh.of.writers--
+	}
+
+	if fh.of.handles > 0 {
+		return false
+	}
+
+	delete(ht.files, fh.f.Inode)
+	return true
+}
+
+// isLastWriter returns true if no other handle can write to the file of
+// fh.
+func (ht *handleTable) isLastWriter(fh *FileHandle) bool {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	return fh.writable && fh.of.writers == 1
+}
+
+// lookup returns the open file of inode, if any.
+func (ht *handleTable) lookup(inode uint64) *openFile {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	return ht.files[inode]
+}
+
+// count returns the number of open handles.
+func (ht *handleTable) count() int {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	return len(ht.handles)
+}
+
+// openFiles returns all currently open files.
+func (ht *handleTable) openFiles() []*openFile {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	files := make([]*openFile, 0, len(ht.files))
+	for _, of := range ht.files {
+		files = append(files, of)
+	}
+	return files
+}
+
+// inUse returns true if cachePath is the cache file of an open file.
+func (ht *handleTable) inUse(cachePath string) bool {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	for _, of := range ht.files {
+		if of.cachePath == cachePath {
+			return true
+		}
+	}
+	return false
+}
+
+// writingBelow returns true if a file with a remote path starting with
+// prefix is open for writing.
+func (ht *handleTable) writingBelow(prefix string) bool {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	for _, of := range ht.files {
+		if of.writers > 0 && strings.HasPrefix(of.f.RemotePath(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeUnused removes cachePath with remove unless it is the cache file
+// of an open file, returns false if it is in use. The check and the
+// removal are atomic with respect to registering open files.
+func (ht *handleTable) removeUnused(cachePath string, remove func(string) error) (bool, error) {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	for _, of := range ht.files {
+		if of.cachePath == cachePath {
+			return false, nil
+		}
+	}
+	return true, remove(cachePath)
+}
+
+// markDirty marks the file as dirty, and records the cache file for
+// recovery.
+func (of *openFile) markDirty() error {
+	of.m.Lock()
+	defer of.m.Unlock()
+
+	if of.isDirty() {
+		return nil
+	}
+
+	if err := of.f.mfs.db.Update(of.recordDirty); err != nil {
+		return err
+	}
+
+	of.storeDirty(true)
+	return nil
+}
+
+// setDirty marks the file as dirty. The cache file is recorded again if it
+// already is, as it may have been rewritten meanwhile.
+func (of *openFile) setDirty() error {
+	of.m.Lock()
+	defer of.m.Unlock()
+
+	// changes are uploaded to the top layer
+	of.f.Layer = 0
+
+	if err := of.f.mfs.db.Update(func(tx *meta.Tx) error {
+		if err := of.recordDirty(tx); err != nil {
+			return err
+		}
+		return of.f.store(tx)
+	}); err != nil {
+		return err
+	}
+
+	of.storeDirty(true)
+	return nil
+}
+
+// isDirty returns true if the cache file has changes not yet uploaded.
+func (of *openFile) isDirty() bool {
+	return atomic.LoadInt32(&of.dirty) == 1
+}
+
+// storeDirty sets whether the cache file has changes not yet uploaded,
+// called with of.m held.
+func (of *openFile) storeDirty(dirty bool) {
+	var v int32
+	if dirty {
+		v = 1
+	}
+	atomic.StoreInt32(&of.dirty, v)
+}
+
+// partial returns true if the cache file holds only appended bytes, or
+// blocks of the content have not been fetched yet.
+func (of *openFile) partial() bool {
+	if of.sparse != nil && !of.sparse.complete() {
+		return true
+	}
+
+	of.baseM.RLock()
+	defer of.baseM.RUnlock()
+
+	return of.base > 0
+}
+
+// readAt reads from the file at off.
+func (of *openFile) readAt(p []byte, off int64) (int, error) {
+	if err := of.fetchBelow(off); err != nil {
+		return 0, err
+	}
+
+	if of.sparse != nil {
+		if err := of.ensure(off, int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+
+	of.baseM.RLock()
+	defer of.baseM.RUnlock()
+
+	return of.ReadAt(p, off-of.base)
+}
+
+// writeAt writes to the file at off.
+func (of *openFile) writeAt(p []byte, off int64) (int, error) {
+	if err := of.fetchBelow(off); err != nil {
+		return 0, err
+	}
+
+	if err := of.fill(); err != nil {
+		return 0, err
+	}
+
+	of.baseM.RLock()
+	defer of.baseM.RUnlock()
+
+	return of.WriteAt(p, off-of.base)
+}
+
+// fetchBelow fetches the object if off is before the bytes in the cache
+// file.
+func (of *openFile) fetchBelow(off int64) error {
+	of.baseM.RLock()
+	fetched := off >= of.base
+	of.baseM.RUnlock()
+
+	if fetched {
+		return nil
+	}
+	return of.fetchAll()
+}
+
+// fetchAll fetches the object if the cache file holds only appended bytes.
+func (of *openFile) fetchAll() error {
+	of.baseM.Lock()
+	fetched, err := of.fetch()
+	of.baseM.Unlock()
+
+	if err != nil || !fetched || !of.isDirty() {
+		return err
+	}
+
+	// recovery has to upload the complete file now
+	return of.setDirty()
+}
+
+// resize truncates the cache file to the file size size. Truncating
+// appended bytes fetches the object first, unless the file is truncated
+// completely.
+func (of *openFile) resize(size int64) error {
+	of.baseM.RLock()
+	fetch := size > 0 && size < of.base+of.appended
+	of.baseM.RUnlock()
+
+	if fetch {
+		if err := of.fetchAll(); err != nil {
+			return err
+		}
+	}
+
+	if size == 0 {
+		of.settle()
+	} else if err := of.fill(); err != nil {
+		return err
+	}
+
+	of.baseM.Lock()
+	defer of.baseM.Unlock()
+
+	if size == 0 {
+		of.base, of.appended = 0, 0
+	}
+
+	fi, err := of.Stat()
+	if err != nil {
+		return err
+	}
+
+	// growth is reserved, shrinking releases the space
+	grown := size - of.base - fi.Size()
+	if err = of.f.mfs.reserveCache(grown); err != nil {
+		return err
+	}
+	if err = of.Truncate(size - of.base); err != nil {
+		if grown > 0 {
+			of.f.mfs.releaseCache(grown)
+		}
+		return err
+	}
+	if grown < 0 {
+		of.f.mfs.releaseCache(-grown)
+	}
+	return nil
+}
+
+// truncate truncates the file to size.
+func (of *openFile) truncate(size int64) error {
+	if err := of.resize(size); err != nil {
+		return err
+	}
+	return of.setDirty()
+}
+
+// flush uploads the cache file if it has been written to, until ctx is
+// done.
+func (of *openFile) flush(ctx context.Context) error {
+	of.m.Lock()
+	defer of.m.Unlock()
+
+	if !of.isDirty() {
+		return nil
+	}
+
+	// the file may have been written by the host which took the lease
+	// over, the changes are kept in the cache till the file is recovered.
+	if of.lease != nil && of.lease.isLost() {
+		return errLeased
+	}
+
+	of.baseM.RLock()
+	defer of.baseM.RUnlock()
+
+	// handles may have changed the size through different nodes, the
+	// cache file is authoritative.
+	fi, err := of.Stat()
+	if err != nil {
+		return err
+	}
+	of.f.Size = uint64(of.base + fi.Size())
+
+	if of.base > 0 {
+		return of.flushAppend(ctx, fi.Size())
+	}
+
+	sr := newPutOp(ctx, of.Name(), of.f.RemotePath(), fi.Size())
+	if err := of.f.mfs.sync(ctx, &sr); err != nil {
+		return err
+	}
+
+	// we'll wait for the request to be uploaded and synced, before
+	// releasing the file
+	if err := <-sr.Error; err == errOffline {
+		return of.postpone()
+	} else if err != nil {
+		return err
+	}
+
+	of.f.ETag = sr.ETag
+	if of.f.mfs.persistCache() {
+		of.f.CachePath = of.cachePath
+		of.f.CacheETag = sr.ETag
+	}
+
+	// update cache
+	if err := of.f.mfs.db.Update(func(tx *meta.Tx) error {
+		if err := of.clearDirty(tx); err != nil {
+			return err
+		}
+		return of.f.store(tx)
+	}); err != nil {
+		return err
+	}
+
+	of.storeDirty(false)
+	return nil
+}
+
+// postpone journals the upload of the file while offline, called with
+// of.m held.
+func (of *openFile) postpone() error {
+	of.f.CachePath = of.cachePath
+	of.f.CacheETag = ""
+
+	if err := of.f.mfs.db.Update(func(tx *meta.Tx) error {
+		if err := of.journal(tx); err != nil {
+			return err
+		}
+		if err := of.clearDirty(tx); err != nil {
+			return err
+		}
+		return of.f.store(tx)
+	}); err != nil {
+		return err
+	}
+
+	of.f.mfs.log.Printf("Server unreachable, journaled upload of %s.\n", of.f.FullPath())
+	of.storeDirty(false)
+	return nil
+}
+
+// acquireLease leases the file for writing, if leases are enabled.
+func (of *openFile) acquireLease(ctx context.Context) error {
+	of.m.Lock()
+	defer of.m.Unlock()
+
+	if !of.f.mfs.config.leases || of.lease != nil {
+		return nil
+	}
+
+	lh, err := of.f.mfs.acquireLease(ctx, of.f.RemotePath())
+	if err != nil {
+		return err
+	}
+
+	of.lease = lh
+	return nil
+}
+
+// releaseLease releases the lease of the file, once it is not open for
+// writing anymore.
+func (of *openFile) releaseLease(ctx context.Context) {
+	of.m.Lock()
+	defer of.m.Unlock()
+
+	if of.lease == nil {
+		return
+	}
+
+	if err := of.lease.release(ctx); err != nil {
+		of.f.mfs.log.Errorf("Unable to release lease of %s: %s\n", of.f.FullPath(), err)
+	}
+	of.lease = nil
+}
+
+// reserve accounts for the growth of the cache file to size bytes.
+func (of *openFile) reserve(size int64) error {
+	if !of.f.mfs.cacheLimited() {
+		return nil
+	}
+
+	of.baseM.RLock()
+	defer of.baseM.RUnlock()
+
+	fi, err := of.Stat()
+	if err != nil {
+		return err
+	}
+	return of.f.mfs.reserveCache(size - of.base - fi.Size())
+}
+
+// close closes the cache file once the last handle has been released,
+// keeping it if it has changes which couldn't be uploaded.
+func (of *openFile) close() error {
+	of.closeSparse()
+
+	if err := of.Close(); err != nil {
+		return err
+	}
+
+	if of.isDirty() {
+		of.f.mfs.log.Warnf("Unfinished upload of %s, changes are kept in %s.\n", of.f.FullPath(), of.cachePath)
+		return nil
+	}
+
+	mfs := of.f.mfs
+	if of.partial() {
+		// appended bytes or some blocks alone are of no use as cache
+		return mfs.removeCacheFile(of.cachePath)
+	}
+
+	if !mfs.persistCache() {
+		mfs.removeCache(of.cachePath)
+		return nil
+	}
+
+	// record the last access for eviction
+	fi, err := os.Stat(of.cachePath)
+	if err != nil {
+		return err
+	}
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		// content fetched when read is kept once complete
+		if of.sparse != nil && mfs.persistCache() && of.f.CachePath != of.cachePath {
+			of.f.keepCache(of.cachePath, of.sparse.etag)
+			if err := of.f.store(tx); err != nil {
+				return err
+			}
+		}
+		return mfs.touchCache(tx, of.cachePath, fi.Size())
+	})
+}
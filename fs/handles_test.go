@@ -0,0 +1,175 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import "testing"
+
+func TestHandleTableShare(t *testing.T) {
+	ht := newHandleTable()
+	f := &File{Inode: 1}
+
+	if fh := ht.share(f, false); fh != nil {
+		t.Fatalf("Expected no handle of a file which isn't open, got %d", fh.handle)
+	}
+
+	of := &openFile{cachePath: "a"}
+	fh1, ok := ht.register(f, of, true)
+	if !ok {
+		t.Fatal("Expected the first open file to be registered")
+	}
+
+	fh2 := ht.share(f, false)
+	if fh2 == nil || fh2.of != of {
+		t.Fatal("Expected a second handle sharing the open file")
+	}
+
+	// a concurrent open discards its own open file
+	fh3, ok := ht.register(f, &openFile{cachePath: "b"}, false)
+	if ok || fh3.of != of {
+		t.Fatal("Expected a concurrent open to share the registered open file")
+	}
+
+	if of.handles != 3 || of.writers != 1 {
+		t.Fatalf("Expected 3 handles and 1 writer, got %d and %d", of.handles, of.writers)
+	}
+
+	if ht.release(fh1) || ht.release(fh2) {
+		t.Fatal("Expected the open file to be kept while handles are left")
+	}
+	if ht.lookup(f.Inode) != of {
+		t.Fatal("Expected the open file to be found by its inode")
+	}
+	if !ht.inUse("a") || ht.inUse("b") {
+		t.Fatal("Expected only the registered cache file to be in use")
+	}
+
+	if !ht.release(fh3) {
+		t.Fatal("Expected the release of the last handle to close the open file")
+	}
+	if ht.lookup(f.Inode) != nil || ht.inUse("a") || ht.count() != 0 {
+		t.Fatal("Expected no open files after releasing all handles")
+	}
+}
+
+func TestHandleTableIDReuse(t *testing.T) {
+	ht := newHandleTable()
+	f1, f2 := &File{Inode: 1}, &File{Inode: 2}
+
+	fh1, _ := ht.register(f1, &openFile{}, false)
+	fh2, _ := ht.register(f2, &openFile{}, false)
+	fh3 := ht.share(f1, false)
+	if fh1.handle != 0 || fh2.handle != 1 || fh3.handle != 2 {
+		t.Fatalf("Expected handle ids 0, 1 and 2, got %d, %d and %d", fh1.handle, fh2.handle, fh3.handle)
+	}
+
+	ht.release(fh2)
+	ht.release(fh1)
+
+	// the last released id is reused first
+	if fh := ht.share(f1, false); fh.handle != 0 {
+		t.Fatalf("Expected released handle id 0 to be reused, got %d", fh.handle)
+	}
+	if fh, _ := ht.register(f2, &openFile{}, false); fh.handle != 1 {
+		t.Fatalf("Expected released handle id 1 to be reused, got %d", fh.handle)
+	}
+	if fh := ht.share(f2, false); fh.handle != 3 {
+		t.Fatalf("Expected new handle id 3, got %d", fh.handle)
+	}
+	if n := ht.count(); n != 4 {
+		t.Fatalf("Expected 4 open handles, got %d", n)
+	}
+}
+
+func TestHandleTableIsLastWriter(t *testing.T) {
+	ht := newHandleTable()
+	f := &File{Inode: 1}
+
+	w1, _ := ht.register(f, &openFile{}, true)
+	r := ht.share(f, false)
+	if !ht.isLastWriter(w1) {
+		t.Fatal("Expected the only writer to be the last writer")
+	}
+	if ht.isLastWriter(r) {
+		t.Fatal("Expected a reader never to be the last writer")
+	}
+
+	w2 := ht.share(f, true)
+	if ht.isLastWriter(w1) || ht.isLastWriter(w2) {
+		t.Fatal("Expected no last writer while two writers are open")
+	}
+
+	ht.release(w1)
+	if !ht.isLastWriter(w2) {
+		t.Fatal("Expected the remaining writer to be the last writer")
+	}
+
+	ht.release(w2)
+	if ht.isLastWriter(r) {
+		t.Fatal("Expected a reader never to be the last writer")
+	}
+}
+
+func TestHandleTableRemoveUnused(t *testing.T) {
+	ht := newHandleTable()
+	fh, _ := ht.register(&File{Inode: 1}, &openFile{cachePath: "a"}, false)
+
+	removed := []string{}
+	remove := func(cachePath string) error {
+		removed = append(removed, cachePath)
+		return nil
+	}
+
+	if unused, _ := ht.removeUnused("a", remove); unused {
+		t.Fatal("Expected the cache file of an open file to be kept")
+	}
+	if unused, _ := ht.removeUnused("b", remove); !unused {
+		t.Fatal("Expected an unused cache file to be removed")
+	}
+
+	ht.release(fh)
+	if unused, _ := ht.removeUnused("a", remove); !unused {
+		t.Fatal("Expected a released cache file to be removed")
+	}
+	if len(removed) != 2 || removed[0] != "b" || removed[1] != "a" {
+		t.Fatalf("Expected b and a to be removed, got %v", removed)
+	}
+}
+
+func TestHandleTableWritingBelow(t *testing.T) {
+	ht := newHandleTable()
+	mfs := &MinFS{config: &Config{bucket: "bucket"}}
+	root := &Dir{mfs: mfs}
+	dir := &Dir{dir: root, mfs: mfs, Path: "a"}
+
+	fr := &File{Inode: 1, dir: dir, mfs: mfs, Path: "x"}
+	r, _ := ht.register(fr, &openFile{f: fr}, false)
+	if ht.writingBelow("a/") {
+		t.Fatal("Expected a file open for reading not to be pending")
+	}
+
+	fw := &File{Inode: 2, dir: dir, mfs: mfs, Path: "y"}
+	w, _ := ht.register(fw, &openFile{f: fw}, true)
+	if !ht.writingBelow("a/") || ht.writingBelow("ab/") {
+		t.Fatal("Expected only the directory of the file open for writing to be pending")
+	}
+
+	ht.release(w)
+	ht.release(r)
+	if ht.writingBelow("a/") {
+		t.Fatal("Expected no pending files after releasing all handles")
+	}
+}
@@ -0,0 +1,256 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// prefix of objects used by MinFS itself, hidden from listings.
+const internalPrefix = ".minfs/"
+
+// prefix of the lease objects of files.
+const leasePrefix = internalPrefix + "locks/"
+
+// errLeased is returned when a file is leased by an other host.
+var errLeased = fuse.Errno(syscall.EBUSY)
+
+// lease is the content of a lease object.
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseHolder renews a lease held by this instance until released.
+type leaseHolder struct {
+	mfs *MinFS
+	key string
+
+	etag    string
+	expires time.Time
+
+	// set once the lease may have been taken over by an other host
+	lost int32
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// newHolderID returns an identifier of this instance for lease objects.
+func newHolderID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), nextSuffix())
+}
+
+// getLease returns the lease object key and its etag.
+func (mfs *MinFS) getLease(ctx context.Context, key string) (l lease, etag string, err error) {
+	err = mfs.s3(ctx, "GetObject", key, func() error {
+		bucket, object := mfs.splitPath(key)
+		obj, gerr := mfs.client(key).GetObject(bucket, object)
+		if gerr != nil {
+			return gerr
+		}
+		defer obj.Close()
+
+		info, gerr := obj.Stat()
+		if gerr != nil {
+			return gerr
+		}
+
+		data, gerr := ioutil.ReadAll(obj)
+		if gerr != nil {
+			return gerr
+		}
+
+		etag = info.ETag
+		return json.Unmarshal(data, &l)
+	})
+	return l, etag, err
+}
+
+// putLease writes the lease object key, if the conditional header
+// header=value holds. Backends without conditional writes ignore it.
+func (mfs *MinFS) putLease(ctx context.Context, key string, l lease, header, value string) (etag string, err error) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+
+	err = mfs.s3(ctx, "PutObject", key, func() error {
+		resp, perr := mfs.request(ctx, "PUT", key, nil, data, http.Header{header: {value}})
+		if perr != nil {
+			return perr
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			etag = strings.Trim(resp.Header.Get("ETag"), "\"")
+			return nil
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return errLeased
+		}
+		return responseError(resp)
+	})
+	return etag, err
+}
+
+// acquireLease leases remotePath for this instance, failing with
+// errLeased if an other host holds an unexpired lease.
+func (mfs *MinFS) acquireLease(ctx context.Context, remotePath string) (*leaseHolder, error) {
+	key := mfs.internalPath(leasePrefix, remotePath)
+
+	header, value := "If-None-Match", "*"
+	if current, etag, err := mfs.getLease(ctx, key); err == nil {
+		if current.Holder != mfs.holderID && time.Now().Before(current.Expires) {
+			return nil, errLeased
+		}
+		// take over the expired lease, unless it changed meanwhile
+		header, value = "If-Match", etag
+	} else if err != fuse.ENOENT {
+		return nil, err
+	}
+
+	expires := time.Now().UTC().Add(mfs.config.leaseTTL)
+	etag, err := mfs.putLease(ctx, key, lease{
+		Holder:  mfs.holderID,
+		Expires: expires,
+	}, header, value)
+	if err != nil {
+		return nil, err
+	}
+
+	// verify the lease for backends ignoring the condition
+	if current, _, err := mfs.getLease(ctx, key); err != nil {
+		return nil, err
+	} else if current.Holder != mfs.holderID {
+		return nil, errLeased
+	}
+
+	lh := &leaseHolder{
+		mfs:     mfs,
+		key:     key,
+		etag:    etag,
+		expires: expires,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go lh.renew()
+	return lh, nil
+}
+
+// renew extends the lease until it is released.
+func (lh *leaseHolder) renew() {
+	defer close(lh.doneCh)
+
+	ticker := time.NewTicker(lh.mfs.config.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lh.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		expires := time.Now().UTC().Add(lh.mfs.config.leaseTTL)
+		etag, err := lh.mfs.putLease(context.Background(), lh.key, lease{
+			Holder:  lh.mfs.holderID,
+			Expires: expires,
+		}, "If-Match", lh.etag)
+		if err == errLeased {
+			lh.mfs.logger(subsystemSync).WithField("path", lh.key).Errorln("Lease has been taken over by an other host.")
+			atomic.StoreInt32(&lh.lost, 1)
+			return
+		} else if err != nil {
+			lh.mfs.logger(subsystemSync).WithField("path", lh.key).Warnln("Unable to renew lease.", err)
+			// an other host may take over once the lease expired
+			if time.Now().After(lh.expires) {
+				atomic.StoreInt32(&lh.lost, 1)
+			}
+			continue
+		}
+		// unchanged since, so nobody took it over meanwhile
+		lh.etag, lh.expires = etag, expires
+		atomic.StoreInt32(&lh.lost, 0)
+	}
+}
+
+// isLost returns true if the lease has been taken over or expired, so
+// the file may have been written by an other host meanwhile.
+func (lh *leaseHolder) isLost() bool {
+	return atomic.LoadInt32(&lh.lost) != 0
+}
+
+// release stops renewing the lease and removes it, unless it has been
+// taken over. The lease is expired first, so backends ignoring the
+// condition of the removal only remove a lease taken over within the
+// instant in between.
+func (lh *leaseHolder) release(ctx context.Context) error {
+	close(lh.stopCh)
+	<-lh.doneCh
+
+	if lh.isLost() {
+		return nil
+	}
+
+	etag, err := lh.mfs.putLease(ctx, lh.key, lease{
+		Holder:  lh.mfs.holderID,
+		Expires: time.Now().UTC(),
+	}, "If-Match", lh.etag)
+	if err == errLeased {
+		return nil
+	} else if err != nil || etag == "" {
+		return err
+	}
+	return lh.mfs.deleteLease(ctx, lh.key, etag)
+}
+
+// deleteLease removes the lease object key, unless it has been replaced
+// since it had etag.
+func (mfs *MinFS) deleteLease(ctx context.Context, key, etag string) error {
+	return mfs.s3(ctx, "RemoveObject", key, func() error {
+		resp, err := mfs.request(ctx, "DELETE", key, nil, nil, http.Header{"If-Match": {etag}})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+			return nil
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			// taken over meanwhile
+			return nil
+		}
+		return responseError(resp)
+	})
+}
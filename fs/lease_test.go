@@ -0,0 +1,136 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// conditionalStore is a bucket of objects honoring conditional writes and
+// deletes.
+type conditionalStore struct {
+	m       sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	version int
+}
+
+func newConditionalStore() *conditionalStore {
+	return &conditionalStore{
+		objects: map[string][]byte{},
+		etags:   map[string]string{},
+	}
+}
+
+func (cs *conditionalStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cs.m.Lock()
+	defer cs.m.Unlock()
+
+	key := r.URL.Path
+	etag, exists := cs.etags[key]
+	if match := strings.Trim(r.Header.Get("If-Match"), "\""); match != "" && match != etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+			return
+		}
+		w.Header().Set("ETag", "\""+etag+"\"")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(cs.objects[key])))
+		w.Write(cs.objects[key])
+	case "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		cs.version++
+		cs.objects[key] = data
+		cs.etags[key] = fmt.Sprintf("etag%d", cs.version)
+		w.Header().Set("ETag", "\""+cs.etags[key]+"\"")
+	case "DELETE":
+		delete(cs.objects, key)
+		delete(cs.etags, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestLeaseRelease(t *testing.T) {
+	store := newConditionalStore()
+	mfs, cleanup := newTestFS(t, store)
+	defer cleanup()
+
+	mfs.config.leases, mfs.config.leaseTTL = true, time.Minute
+	mfs.holderID = "host"
+
+	lh, err := mfs.acquireLease(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.objects["/bucket/.minfs/locks/file"]; !ok {
+		t.Fatalf("Expected a lease object, got %v", store.objects)
+	}
+
+	if err = lh.release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.objects) != 0 {
+		t.Errorf("Expected the lease object to be removed, got %v", store.objects)
+	}
+}
+
+func TestLeaseReleaseTakenOver(t *testing.T) {
+	store := newConditionalStore()
+	mfs, cleanup := newTestFS(t, store)
+	defer cleanup()
+
+	mfs.config.leases, mfs.config.leaseTTL = true, time.Minute
+	mfs.holderID = "host"
+
+	lh, err := mfs.acquireLease(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an other host replaces the lease
+	store.m.Lock()
+	store.objects["/bucket/.minfs/locks/file"] = []byte(`{"holder":"other"}`)
+	store.etags["/bucket/.minfs/locks/file"] = "other"
+	store.m.Unlock()
+
+	if err = lh.release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if string(store.objects["/bucket/.minfs/locks/file"]) != `{"holder":"other"}` {
+		t.Errorf("Expected the lease of the other host to be kept, got %v", store.objects)
+	}
+}
@@ -17,54 +17,188 @@
 package minfs
 
 import (
-	"time"
+	"sync"
+	"syscall"
 
 	"bazil.org/fuse"
+	"golang.org/x/net/context"
 )
 
-// Unlock - unlock the lock at path.
-func (mfs *MinFS) Unlock(path string) error {
-	mfs.m.Lock()
-	defer mfs.m.Unlock()
+// byteLock is an advisory lock on the byte range start-end (inclusive) of
+// a file.
+type byteLock struct {
+	owner uint64
+	// the handle the lock has been acquired through
+	handle uint64
+	pid    int32
+	flock  bool
+	typ    fuse.LockType
+	start  uint64
+	end    uint64
+}
 
-	delete(mfs.locks, path)
+// overlaps returns true if l and o lock a common byte.
+func (l byteLock) overlaps(o byteLock) bool {
+	return l.start <= o.end && o.start <= l.end
+}
 
-	return nil
+// conflicts returns true if l and o can't be held at the same time. flock
+// and POSIX locks don't interact with each other.
+func (l byteLock) conflicts(o byteLock) bool {
+	if l.owner == o.owner || l.flock != o.flock || !l.overlaps(o) {
+		return false
+	}
+	return l.typ == fuse.LockWrite || o.typ == fuse.LockWrite
 }
 
-// Lock - acquires a lock at path.
-func (mfs *MinFS) Lock(path string) error {
-	mfs.m.Lock()
-	defer mfs.m.Unlock()
+// lockManager keeps the fcntl and flock locks of all files of the
+// filesystem.
+type lockManager struct {
+	m sync.Mutex
 
-	mfs.locks[path] = true
-	return nil
+	// locks by inode
+	locks map[uint64][]byteLock
+
+	// closed when locks of the inode have been released
+	waiters map[uint64]chan struct{}
 }
 
-// IsLocked returns if the path is currently locked
-func (mfs *MinFS) IsLocked(path string) bool {
-	mfs.m.Lock()
-	defer mfs.m.Unlock()
+func newLockManager() *lockManager {
+	return &lockManager{
+		locks:   map[uint64][]byteLock{},
+		waiters: map[uint64]chan struct{}{},
+	}
+}
 
-	_, ok := mfs.locks[path]
-	return ok
+// conflict returns the first lock on inode conflicting with l, called
+// with lm.m held.
+func (lm *lockManager) conflict(inode uint64, l byteLock) (byteLock, bool) {
+	for _, o := range lm.locks[inode] {
+		if l.conflicts(o) {
+			return o, true
+		}
+	}
+	return byteLock{}, false
 }
 
-// wait for the file lock to be unlocked
-func (mfs *MinFS) wait(path string) error {
-	// check if the file is locked, and wait for max 5 seconds for the file to be
-	// acquired
-	for i := 0; ; /* retries */ i++ {
-		if !mfs.IsLocked(path) {
-			break
+// set replaces the range of l of the locks of its owner on inode by l,
+// splitting locks partially covered. An unlock only removes the range.
+// Called with lm.m held.
+func (lm *lockManager) set(inode uint64, l byteLock) {
+	locks := []byteLock{}
+	released := false
+	for _, o := range lm.locks[inode] {
+		if o.owner != l.owner || o.flock != l.flock || !l.overlaps(o) {
+			locks = append(locks, o)
+			continue
 		}
 
-		if i > 25 /* max number of retries */ {
-			return fuse.EPERM
+		released = true
+		if o.start < l.start {
+			head := o
+			head.end = l.start - 1
+			locks = append(locks, head)
+		}
+		if o.end > l.end {
+			tail := o
+			tail.start = l.end + 1
+			locks = append(locks, tail)
 		}
+	}
 
-		time.Sleep(time.Millisecond * 200)
+	if l.typ != fuse.LockUnlock {
+		locks = append(locks, l)
 	}
 
-	return nil
+	if len(locks) == 0 {
+		delete(lm.locks, inode)
+	} else {
+		lm.locks[inode] = locks
+	}
+
+	// downgrades and unlocks may unblock waiters
+	if released {
+		lm.wake(inode)
+	}
+}
+
+// wake wakes the waiters for locks on inode, called with lm.m held.
+func (lm *lockManager) wake(inode uint64) {
+	if ch, ok := lm.waiters[inode]; ok {
+		close(ch)
+		delete(lm.waiters, inode)
+	}
+}
+
+// lock acquires l on inode. If it conflicts with an other lock, it
+// either fails with EAGAIN or waits until ctx is cancelled.
+func (lm *lockManager) lock(ctx context.Context, inode uint64, l byteLock, wait bool) error {
+	for {
+		lm.m.Lock()
+		if _, ok := lm.conflict(inode, l); !ok {
+			lm.set(inode, l)
+			lm.m.Unlock()
+			return nil
+		}
+
+		if !wait {
+			lm.m.Unlock()
+			return fuse.Errno(syscall.EAGAIN)
+		}
+
+		ch, ok := lm.waiters[inode]
+		if !ok {
+			ch = make(chan struct{})
+			lm.waiters[inode] = ch
+		}
+		lm.m.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return fuse.EINTR
+		case <-ch:
+		}
+	}
+}
+
+// unlock releases the range of l held by its owner on inode.
+func (lm *lockManager) unlock(inode uint64, l byteLock) {
+	lm.m.Lock()
+	defer lm.m.Unlock()
+
+	l.typ = fuse.LockUnlock
+	lm.set(inode, l)
+}
+
+// query returns the first lock on inode conflicting with l.
+func (lm *lockManager) query(inode uint64, l byteLock) (byteLock, bool) {
+	lm.m.Lock()
+	defer lm.m.Unlock()
+
+	return lm.conflict(inode, l)
+}
+
+// release removes all locks on inode for which match returns true, as
+// when their owner closes the file.
+func (lm *lockManager) release(inode uint64, match func(byteLock) bool) {
+	lm.m.Lock()
+	defer lm.m.Unlock()
+
+	locks := []byteLock{}
+	for _, l := range lm.locks[inode] {
+		if !match(l) {
+			locks = append(locks, l)
+		}
+	}
+
+	if len(locks) == len(lm.locks[inode]) {
+		return
+	}
+
+	if len(locks) == 0 {
+		delete(lm.locks, inode)
+	} else {
+		lm.locks[inode] = locks
+	}
+	lm.wake(inode)
 }
@@ -0,0 +1,143 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestByteLockConflicts(t *testing.T) {
+	testCases := []struct {
+		l, o     byteLock
+		conflict bool
+	}{
+		// read locks are shared
+		{byteLock{owner: 1, typ: fuse.LockRead, start: 0, end: 9}, byteLock{owner: 2, typ: fuse.LockRead, start: 5, end: 15}, false},
+		{byteLock{owner: 1, typ: fuse.LockWrite, start: 0, end: 9}, byteLock{owner: 2, typ: fuse.LockRead, start: 5, end: 15}, true},
+		{byteLock{owner: 1, typ: fuse.LockRead, start: 0, end: 9}, byteLock{owner: 2, typ: fuse.LockWrite, start: 9, end: 9}, true},
+		// ranges are inclusive
+		{byteLock{owner: 1, typ: fuse.LockWrite, start: 0, end: 9}, byteLock{owner: 2, typ: fuse.LockWrite, start: 10, end: 19}, false},
+		// an owner never conflicts with itself
+		{byteLock{owner: 1, typ: fuse.LockWrite, start: 0, end: 9}, byteLock{owner: 1, typ: fuse.LockWrite, start: 0, end: 9}, false},
+		// flock and POSIX locks don't interact
+		{byteLock{owner: 1, typ: fuse.LockWrite, start: 0, end: 9}, byteLock{owner: 2, flock: true, typ: fuse.LockWrite, start: 0, end: 9}, false},
+	}
+
+	for i, testCase := range testCases {
+		if conflict := testCase.l.conflicts(testCase.o); conflict != testCase.conflict {
+			t.Errorf("Test %d: Expected conflict %v, got %v", i+1, testCase.conflict, conflict)
+		}
+		if conflict := testCase.o.conflicts(testCase.l); conflict != testCase.conflict {
+			t.Errorf("Test %d: Expected symmetric conflict %v, got %v", i+1, testCase.conflict, conflict)
+		}
+	}
+}
+
+func TestLockManagerSet(t *testing.T) {
+	testCases := []struct {
+		held   []byteLock
+		l      byteLock
+		result []byteLock
+	}{
+		// unlocking the middle splits the lock
+		{
+			[]byteLock{{owner: 1, typ: fuse.LockWrite, start: 0, end: 99}},
+			byteLock{owner: 1, typ: fuse.LockUnlock, start: 10, end: 19},
+			[]byteLock{{owner: 1, typ: fuse.LockWrite, start: 0, end: 9}, {owner: 1, typ: fuse.LockWrite, start: 20, end: 99}},
+		},
+		// downgrading the head keeps the tail
+		{
+			[]byteLock{{owner: 1, typ: fuse.LockWrite, start: 0, end: 99}},
+			byteLock{owner: 1, typ: fuse.LockRead, start: 0, end: 49},
+			[]byteLock{{owner: 1, typ: fuse.LockWrite, start: 50, end: 99}, {owner: 1, typ: fuse.LockRead, start: 0, end: 49}},
+		},
+		// a lock covering several locks replaces them
+		{
+			[]byteLock{{owner: 1, typ: fuse.LockRead, start: 0, end: 9}, {owner: 1, typ: fuse.LockRead, start: 20, end: 29}},
+			byteLock{owner: 1, typ: fuse.LockWrite, start: 5, end: 24},
+			[]byteLock{{owner: 1, typ: fuse.LockRead, start: 0, end: 4}, {owner: 1, typ: fuse.LockRead, start: 25, end: 29}, {owner: 1, typ: fuse.LockWrite, start: 5, end: 24}},
+		},
+		// locks of other owners and kinds are kept
+		{
+			[]byteLock{{owner: 2, typ: fuse.LockRead, start: 0, end: 9}, {owner: 1, flock: true, typ: fuse.LockRead, start: 0, end: 9}},
+			byteLock{owner: 1, typ: fuse.LockUnlock, start: 0, end: 9},
+			[]byteLock{{owner: 2, typ: fuse.LockRead, start: 0, end: 9}, {owner: 1, flock: true, typ: fuse.LockRead, start: 0, end: 9}},
+		},
+		// unlocking everything removes the inode
+		{
+			[]byteLock{{owner: 1, typ: fuse.LockWrite, start: 10, end: 19}},
+			byteLock{owner: 1, typ: fuse.LockUnlock, start: 0, end: 99},
+			nil,
+		},
+	}
+
+	for i, testCase := range testCases {
+		lm := newLockManager()
+		lm.locks[1] = testCase.held
+		lm.set(1, testCase.l)
+		if result := lm.locks[1]; !reflect.DeepEqual(result, testCase.result) {
+			t.Errorf("Test %d: Expected locks %v, got %v", i+1, testCase.result, result)
+		}
+	}
+}
+
+func TestLockManagerConflict(t *testing.T) {
+	lm := newLockManager()
+	lm.set(1, byteLock{owner: 1, typ: fuse.LockWrite, start: 0, end: 99})
+	lm.set(1, byteLock{owner: 1, typ: fuse.LockUnlock, start: 40, end: 59})
+
+	if _, ok := lm.conflict(1, byteLock{owner: 2, typ: fuse.LockRead, start: 40, end: 59}); ok {
+		t.Fatal("Expected the unlocked range to be free")
+	}
+	o, ok := lm.conflict(1, byteLock{owner: 2, typ: fuse.LockRead, start: 50, end: 69})
+	if !ok || o.start != 60 || o.end != 99 {
+		t.Fatalf("Expected a conflict with the tail 60-99, got %v", o)
+	}
+	if _, ok := lm.conflict(2, byteLock{owner: 2, typ: fuse.LockWrite, start: 0, end: 99}); ok {
+		t.Fatal("Expected no conflict on an other inode")
+	}
+}
+
+func TestLockManagerRelease(t *testing.T) {
+	lm := newLockManager()
+	lm.set(1, byteLock{owner: 1, handle: 1, typ: fuse.LockWrite, start: 0, end: 9})
+	lm.set(1, byteLock{owner: 1, handle: 1, flock: true, typ: fuse.LockWrite, start: 0, end: 9})
+	lm.set(1, byteLock{owner: 2, handle: 2, typ: fuse.LockRead, start: 20, end: 29})
+
+	ch := make(chan struct{})
+	lm.waiters[1] = ch
+
+	// closing a descriptor releases the POSIX locks of its owner
+	lm.release(1, func(l byteLock) bool { return !l.flock && l.owner == 1 })
+	select {
+	case <-ch:
+	default:
+		t.Fatal("Expected waiters to be woken up")
+	}
+	if len(lm.locks[1]) != 2 {
+		t.Fatalf("Expected 2 locks left, got %v", lm.locks[1])
+	}
+
+	lm.release(1, func(l byteLock) bool { return l.handle == 1 })
+	lm.release(1, func(l byteLock) bool { return l.handle == 2 })
+	if _, ok := lm.locks[1]; ok {
+		t.Fatal("Expected no locks left after releasing all handles")
+	}
+}
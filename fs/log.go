@@ -0,0 +1,221 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Subsystems which can be selected for debug logging.
+const (
+	subsystemFuse  = "fuse"
+	subsystemS3    = "s3"
+	subsystemCache = "cache"
+	subsystemSync  = "sync"
+)
+
+var subsystems = []string{subsystemFuse, subsystemS3, subsystemCache, subsystemSync}
+
+// rotatingWriter writes to a log file, rotating it once it exceeds
+// maxSize bytes and keeping at most maxBackups rotated files.
+type rotatingWriter struct {
+	m sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	w := &rotatingWriter{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = fi.Size()
+	return nil
+}
+
+// Write appends p to the log file, rotating first if necessary.
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N to path.N+1, moves the current file to path.1 and
+// opens a new one.
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	for i := w.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+
+	if w.maxBackups > 0 {
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+// Reopen closes and reopens the log file, used after external rotation.
+func (w *rotatingWriter) Reopen() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// newLogger returns the logger configured by cfg.
+func newLogger(cfg *Config) (*logrus.Logger, *rotatingWriter, error) {
+	w, err := newRotatingWriter(cfg.logFile, cfg.logMaxSize, cfg.logMaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger := logrus.New()
+	logger.Out = w
+	logger.Level = cfg.logLevel
+
+	switch cfg.logFormat {
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	default:
+		logger.Formatter = &logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		}
+	}
+
+	return logger, w, nil
+}
+
+// debugEnabled returns true if debug logs of subsystem are enabled.
+func (mfs *MinFS) debugEnabled(subsystem string) bool {
+	if mfs.log.Level < logrus.DebugLevel {
+		return false
+	}
+	return len(mfs.config.debug) == 0 || mfs.config.debug[subsystem]
+}
+
+// logger returns a log entry for subsystem.
+func (mfs *MinFS) logger(subsystem string) *logrus.Entry {
+	return mfs.log.WithField("subsystem", subsystem)
+}
+
+// trace tracks a single operation of a subsystem for logging.
+type trace struct {
+	mfs *MinFS
+
+	subsystem string
+	op        string
+	path      string
+	handle    interface{}
+	start     time.Time
+}
+
+// trace starts tracking operation op of subsystem on path.
+func (mfs *MinFS) trace(subsystem, op, path string) *trace {
+	return &trace{
+		mfs:       mfs,
+		subsystem: subsystem,
+		op:        op,
+		path:      path,
+		start:     time.Now(),
+	}
+}
+
+// done logs the outcome of the operation, errors of other than fuse
+// operations are always logged.
+func (t *trace) done(err *error) {
+	duration := time.Since(t.start)
+
+	var e error
+	if err != nil {
+		e = *err
+	}
+	t.mfs.metrics.observe(t.subsystem, t.op, duration, e)
+
+	if (err == nil || *err == nil || t.subsystem == subsystemFuse) && !t.mfs.debugEnabled(t.subsystem) {
+		return
+	}
+
+	entry := t.mfs.logger(t.subsystem).WithFields(logrus.Fields{
+		"op":       t.op,
+		"path":     t.path,
+		"duration": duration,
+	})
+	if t.handle != nil {
+		entry = entry.WithField("handle", t.handle)
+	}
+
+	if err != nil && *err != nil {
+		entry = entry.WithError(*err)
+		if t.subsystem != subsystemFuse {
+			entry.Errorln("Operation failed.")
+			return
+		}
+	}
+
+	entry.Debugln("Operation finished.")
+}
@@ -0,0 +1,295 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default latency buckets in seconds.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// metric writes itself in the prometheus text exposition format.
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	m      sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: map[string]float64{},
+	}
+}
+
+// Add adds v to the counter of value.
+func (c *counterVec) Add(value string, v float64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.values[value] += v
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, value := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s{%s=%q} %s\n", c.name, c.label, value, formatFloat(c.values[value]))
+	}
+}
+
+// counter is a single counter.
+type counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// Add adds v to the counter.
+func (c *counter) Add(v uint64) {
+	atomic.AddUint64(&c.value, v)
+}
+
+func (c *counter) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, atomic.LoadUint64(&c.value))
+}
+
+// gaugeFunc is a gauge evaluated at collection time.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (g *gaugeFunc) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+// histogram holds the observations of one series.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram partitioned by the value of a single label.
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	m      sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help, label string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: latencyBuckets,
+		series:  map[string]*histogram{},
+	}
+}
+
+// Observe adds an observation of v to the series of value.
+func (h *histogramVec) Observe(value string, v float64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	s, ok := h.series[value]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = s
+	}
+
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	values := make([]string, 0, len(h.series))
+	for value := range h.series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		s := h.series[value]
+		for i, le := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket{%s=%q,le=%q} %d\n", h.name, h.label, value, formatFloat(le), s.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, value, s.count)
+		fmt.Fprintf(buf, "%s_sum{%s=%q} %s\n", h.name, h.label, value, formatFloat(s.sum))
+		fmt.Fprintf(buf, "%s_count{%s=%q} %d\n", h.name, h.label, value, s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricSet contains all metrics exported by MinFS.
+type metricSet struct {
+	fuseDuration *histogramVec
+	fuseErrors   *counterVec
+
+	s3Requests *counterVec
+	s3Errors   *counterVec
+	s3Duration *histogramVec
+
+	uploaded   *counter
+	downloaded *counter
+
+	cacheHits   *counterVec
+	cacheMisses *counterVec
+
+	txDuration *histogramVec
+
+	all []metric
+}
+
+func newMetrics(mfs *MinFS) *metricSet {
+	m := &metricSet{
+		fuseDuration: newHistogramVec("minfs_fuse_operation_duration_seconds", "Latency of fuse operations.", "op"),
+		fuseErrors:   newCounterVec("minfs_fuse_operation_errors_total", "Number of failed fuse operations.", "op"),
+		s3Requests:   newCounterVec("minfs_s3_requests_total", "Number of S3 requests.", "api"),
+		s3Errors:     newCounterVec("minfs_s3_errors_total", "Number of failed S3 requests.", "api"),
+		s3Duration:   newHistogramVec("minfs_s3_request_duration_seconds", "Latency of S3 requests.", "api"),
+		uploaded:     &counter{name: "minfs_uploaded_bytes_total", help: "Number of bytes uploaded."},
+		downloaded:   &counter{name: "minfs_downloaded_bytes_total", help: "Number of bytes downloaded."},
+		cacheHits:    newCounterVec("minfs_cache_hits_total", "Number of cache hits.", "cache"),
+		cacheMisses:  newCounterVec("minfs_cache_misses_total", "Number of cache misses.", "cache"),
+		txDuration:   newHistogramVec("minfs_bolt_transaction_duration_seconds", "Duration of cache database transactions.", "writable"),
+	}
+
+	m.all = []metric{
+		m.fuseDuration, m.fuseErrors,
+		m.s3Requests, m.s3Errors, m.s3Duration,
+		m.uploaded, m.downloaded,
+		&gaugeFunc{
+			name: "minfs_sync_queue_depth",
+			help: "Number of sync operations queued or in progress.",
+			fn:   func() float64 { return float64(atomic.LoadInt64(&mfs.queued)) },
+		},
+		&gaugeFunc{
+			name: "minfs_open_handles",
+			help: "Number of open file handles.",
+			fn:   func() float64 { return float64(mfs.handles.count()) },
+		},
+		m.cacheHits, m.cacheMisses,
+		m.txDuration,
+	}
+	return m
+}
+
+// observe records the outcome of a traced operation.
+func (m *metricSet) observe(subsystem, op string, duration time.Duration, err error) {
+	switch subsystem {
+	case subsystemFuse:
+		m.fuseDuration.Observe(op, duration.Seconds())
+		if err != nil {
+			m.fuseErrors.Add(op, 1)
+		}
+	case subsystemS3:
+		m.s3Requests.Add(op, 1)
+		m.s3Duration.Observe(op, duration.Seconds())
+		if err != nil {
+			m.s3Errors.Add(op, 1)
+		}
+	}
+}
+
+// cacheHit records a hit or miss of cache.
+func (m *metricSet) cacheHit(cache string, hit bool) {
+	if hit {
+		m.cacheHits.Add(cache, 1)
+	} else {
+		m.cacheMisses.Add(cache, 1)
+	}
+}
+
+// observeTx records the duration of a cache database transaction.
+func (m *metricSet) observeTx(writable bool, duration time.Duration) {
+	m.txDuration.Observe(strconv.FormatBool(writable), duration.Seconds())
+}
+
+// ServeHTTP writes all metrics in the prometheus text exposition format.
+func (m *metricSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, metric := range m.all {
+		metric.write(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf.WriteTo(w)
+}
+
+// startMetrics serves the metrics on the configured address.
+func (mfs *MinFS) startMetrics() (net.Listener, error) {
+	l, err := net.Listen("tcp", mfs.config.metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", mfs.metrics)
+
+	go http.Serve(l, mux)
+	return l, nil
+}
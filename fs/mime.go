@@ -0,0 +1,114 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// number of bytes sniffed by http.DetectContentType.
+const sniffLen = 512
+
+// magic identifies a content type by the bytes at an offset.
+type magic struct {
+	offset      int
+	magic       []byte
+	contentType string
+}
+
+// types not detected by http.DetectContentType, consulted first.
+var defaultMagics = []magic{
+	{0, []byte("\xFD7zXZ\x00"), "application/x-xz"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{0, []byte("\x28\xB5\x2F\xFD"), "application/zstd"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{0, []byte("PAR1"), "application/vnd.apache.parquet"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+// typeOverride returns the content type set by a rule for remotePath.
+func (mfs *MinFS) typeOverride(remotePath string) string {
+	contentType, _ := matchRules(mfs.config.mimeTypes, mfs.mountPath(remotePath))
+	return contentType
+}
+
+// contentType returns the content type of the upload of source to
+// remotePath, set by a rule, sniffed from the content if enabled, or by
+// the extension.
+func (mfs *MinFS) contentType(source, remotePath string) string {
+	if contentType := mfs.typeOverride(remotePath); contentType != "" {
+		return contentType
+	}
+
+	byExtension := mime.TypeByExtension(filepath.Ext(mfs.mountPath(remotePath)))
+	if !mfs.config.mimeSniff {
+		return byExtension
+	}
+
+	sniffed, err := mfs.sniff(source)
+	if err != nil {
+		mfs.log.Warnf("Unable to detect content type of %s: %s\n", source, err)
+		return byExtension
+	}
+
+	// generic types tell less than the extension
+	if byExtension != "" && (sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain")) {
+		return byExtension
+	}
+	return sniffed
+}
+
+// sniff detects the content type of the file at name from its first
+// bytes.
+func (mfs *MinFS) sniff(name string) (string, error) {
+	// the configured magics may have spare capacity shared between calls
+	magics := make([]magic, 0, len(mfs.config.mimeMagics)+len(defaultMagics))
+	magics = append(magics, mfs.config.mimeMagics...)
+	magics = append(magics, defaultMagics...)
+
+	n := sniffLen
+	for _, m := range magics {
+		if end := m.offset + len(m.magic); end > n {
+			n = end
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data := make([]byte, n)
+	if n, err = io.ReadFull(f, data); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	data = data[:n]
+
+	for _, m := range magics {
+		if end := m.offset + len(m.magic); end <= len(data) && bytes.Equal(data[m.offset:end], m.magic) {
+			return m.contentType, nil
+		}
+	}
+	return http.DetectContentType(data), nil
+}
@@ -51,6 +51,12 @@ func (mfs *MinFS) startNotificationListener() error {
 						continue
 					}
 
+					key, ok := mfs.decodePath(key)
+					if !ok {
+						// not encrypted with our key
+						continue
+					}
+
 					dir, file := path.Split(key)
 
 					var d *Dir
@@ -0,0 +1,323 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+// errOffline is returned for S3 requests while the server is unreachable.
+var errOffline = fuse.Errno(syscall.ENETUNREACH)
+
+var _ = meta.RegisterExt(4, journalEntry{})
+
+// journalEntry records an upload postponed while offline.
+type journalEntry struct {
+	CachePath  string
+	RemotePath string
+	Length     int64
+
+	// etag of the object the changes are based on.
+	ETag string
+
+	Mtime time.Time
+}
+
+func journalBucket(tx *meta.Tx) *meta.Bucket {
+	return tx.Bucket("journal/")
+}
+
+// isNetworkError returns true if err indicates the server is unreachable.
+func isNetworkError(err error) bool {
+	switch err.(type) {
+	case net.Error, *url.Error:
+		return true
+	}
+	return false
+}
+
+// isOffline returns true if offline mode is enabled and the server is
+// currently unreachable.
+func (mfs *MinFS) isOffline() bool {
+	return mfs.config.offline && atomic.LoadInt32(&mfs.offline) == 1
+}
+
+// setOffline updates the connectivity state, replaying the journal when
+// connectivity returns.
+func (mfs *MinFS) setOffline(offline bool) {
+	var v int32
+	if offline {
+		v = 1
+	}
+	if atomic.SwapInt32(&mfs.offline, v) == v {
+		return
+	}
+
+	if offline {
+		mfs.log.Warnln("Server unreachable, switching to offline mode.")
+		return
+	}
+
+	mfs.log.Println("Server reachable again, replaying journal...")
+	go func() {
+		if err := mfs.replayJournal(); err != nil {
+			mfs.log.Errorln("Unable to replay journal.", err)
+		}
+	}()
+}
+
+// startProbe checks the connectivity to the server periodically, until
+// doneCh is closed.
+func (mfs *MinFS) startProbe(doneCh <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(mfs.config.probeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+			}
+
+			var err error
+			if mfs.isUnion() {
+				src := mfs.config.union.Sources[0]
+				t := mfs.trace(subsystemS3, "BucketExists", src.Name)
+				_, err = mfs.clients[src.Name].BucketExists(src.bucket)
+				t.done(&err)
+			} else if mfs.allBuckets() {
+				t := mfs.trace(subsystemS3, "ListBuckets", "")
+				_, err = mfs.api.ListBuckets()
+				t.done(&err)
+			} else {
+				t := mfs.trace(subsystemS3, "BucketExists", "")
+				_, err = mfs.api.BucketExists(mfs.config.bucket)
+				t.done(&err)
+			}
+
+			mfs.setOffline(isNetworkError(err))
+		}
+	}()
+}
+
+// persistCache returns true if cache files of clean handles are kept
+// after release.
+func (mfs *MinFS) persistCache() bool {
+	return mfs.config.offline || mfs.cacheLimited()
+}
+
+// removeCache removes a cache file no longer used by any handle, unless
+// cache files are persisted.
+func (mfs *MinFS) removeCache(cachePath string) {
+	if mfs.persistCache() {
+		return
+	}
+
+	if err := mfs.removeCacheFile(cachePath); err != nil {
+		mfs.logger(subsystemCache).WithField("path", cachePath).Warnln("Unable to remove cache file.", err)
+	}
+}
+
+// removeStaleCache removes a persisted cache file which has been
+// superseded, unless it is still in use.
+func (mfs *MinFS) removeStaleCache(cachePath string) {
+	mfs.handles.removeUnused(cachePath, mfs.removeCacheFile)
+}
+
+// cachedContent returns the path of the persisted content of the file,
+// if it can be used for a new handle.
+func (f *File) cachedContent() (string, bool) {
+	if !f.mfs.persistCache() || f.CachePath == "" {
+		return "", false
+	}
+
+	// content changed on the server, only relevant while online
+	if !f.mfs.isOffline() && f.CacheETag != f.ETag {
+		return "", false
+	}
+
+	if _, err := os.Stat(f.CachePath); err != nil {
+		return "", false
+	}
+
+	if f.mfs.handles.inUse(f.CachePath) {
+		return "", false
+	}
+
+	return f.CachePath, true
+}
+
+// journal postpones the upload of the open file until the server is
+// reachable again.
+func (of *openFile) journal(tx *meta.Tx) error {
+	return journalBucket(tx).Put(of.f.RemotePath(), journalEntry{
+		CachePath:  of.cachePath,
+		RemotePath: of.f.RemotePath(),
+		Length:     int64(of.f.Size),
+		ETag:       of.f.ETag,
+		Mtime:      time.Now().UTC(),
+	})
+}
+
+// isJournaled returns true if cachePath has a postponed upload.
+func (mfs *MinFS) isJournaled(cachePath string) bool {
+	journaled := false
+	mfs.db.View(func(tx *meta.Tx) error {
+		return journalBucket(tx).ForEach(func(k string, o interface{}) error {
+			if entry, ok := o.(journalEntry); ok && entry.CachePath == cachePath {
+				journaled = true
+			}
+			return nil
+		})
+	})
+	return journaled
+}
+
+// replayJournal uploads all postponed uploads. Changes to objects which
+// have been changed meanwhile are uploaded below lost+found instead.
+func (mfs *MinFS) replayJournal() error {
+	entries := map[string]journalEntry{}
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return journalBucket(tx).ForEach(func(k string, o interface{}) error {
+			if entry, ok := o.(journalEntry); ok {
+				entries[k] = entry
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for k, entry := range entries {
+		if err := mfs.replayEntry(entry); err == errOffline {
+			return err
+		} else if err != nil {
+			mfs.log.Errorf("Unable to replay upload of %s: %s\n", entry.RemotePath, err)
+			continue
+		}
+
+		if err := mfs.db.Update(func(tx *meta.Tx) error {
+			// keep the entry if it has been journaled again meanwhile
+			var current journalEntry
+			if gerr := journalBucket(tx).Get(k, &current); gerr != nil || !current.Mtime.Equal(entry.Mtime) {
+				return nil
+			}
+			return journalBucket(tx).Delete(k)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayEntry uploads the postponed upload of entry.
+func (mfs *MinFS) replayEntry(entry journalEntry) error {
+	fi, err := os.Stat(entry.CachePath)
+	if err != nil {
+		mfs.log.Errorf("Dropping journaled upload of %s: %s\n", entry.RemotePath, err)
+		return nil
+	}
+
+	target := entry.RemotePath
+	changed := mfs.changedSince(entry.RemotePath, entry.ETag)
+	if mfs.isOffline() {
+		return errOffline
+	} else if changed {
+		target = mfs.lostFoundPath(entry.RemotePath, entry.Mtime)
+		mfs.log.Warnf("%s has been changed meanwhile, replaying upload to %s.\n", entry.RemotePath, target)
+	}
+
+	sr := newPutOp(mfs.ctx, entry.CachePath, target, fi.Size())
+	if err = mfs.sync(mfs.ctx, &sr); err != nil {
+		return err
+	}
+	if err = <-sr.Error; err != nil {
+		return err
+	}
+	mfs.log.Printf("Replayed upload of %s.\n", entry.RemotePath)
+
+	if target != entry.RemotePath {
+		return nil
+	}
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		return mfs.storeUploaded(tx, entry, sr.ETag)
+	})
+}
+
+// storeUploaded records etag as the etag of the object and of the cache
+// file of the replayed entry, unless the file has been changed meanwhile.
+func (mfs *MinFS) storeUploaded(tx *meta.Tx, entry journalEntry, etag string) error {
+	p := mfs.mountPath(entry.RemotePath)
+
+	b := mfs.dirBucket(tx, path.Dir(p))
+	if b == nil {
+		return nil
+	}
+
+	var f File
+	if err := b.Get(path.Base(p), &f); meta.IsNoSuchObject(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if f.CachePath != entry.CachePath || f.ETag != entry.ETag {
+		return nil
+	}
+
+	f.ETag = etag
+	f.CacheETag = etag
+	return b.Put(path.Base(p), f)
+}
+
+// dirBucket returns the bucket of the cache database with the entries of
+// the directory at the mount path p, nil if it isn't cached.
+func (mfs *MinFS) dirBucket(tx *meta.Tx, p string) *meta.Bucket {
+	dir, _ := mfs.Root()
+	d := dir.(*Dir)
+
+	b := d.bucket(tx)
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+
+		d = &Dir{mfs: mfs, dir: d, Path: name}
+		if d.isBucket() {
+			b = tx.Bucket(mfs.bucketNamespace(name))
+		} else {
+			b = b.Bucket(name + "/")
+		}
+
+		if b.InnerBucket == nil {
+			return nil
+		}
+	}
+	return b
+}
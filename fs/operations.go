@@ -16,9 +16,21 @@
 
 package minfs
 
+import "golang.org/x/net/context"
+
 // Operation -
 type Operation struct {
 	Error chan error
+
+	// cancels the operation, e.g. when the shutdown timeout is exceeded.
+	ctx context.Context
+}
+
+func newOperation(ctx context.Context) *Operation {
+	return &Operation{
+		Error: make(chan error),
+		ctx:   ctx,
+	}
 }
 
 // MoveOperation - Move source object to target object. Copy source to target, delete the source.
@@ -29,13 +41,11 @@ type MoveOperation struct {
 	Target string
 }
 
-func newMoveOp(sourcePath, targetPath string) MoveOperation {
+func newMoveOp(ctx context.Context, sourcePath, targetPath string) MoveOperation {
 	return MoveOperation{
-		Source: sourcePath,
-		Target: targetPath,
-		Operation: &Operation{
-			Error: make(chan error),
-		},
+		Source:    sourcePath,
+		Target:    targetPath,
+		Operation: newOperation(ctx),
 	}
 }
 
@@ -55,15 +65,43 @@ type PutOperation struct {
 
 	Source string
 	Target string
+
+	// etag of the uploaded object, set on success.
+	ETag string
 }
 
-func newPutOp(sourcePath string, targetPath string, length int64) PutOperation {
+func newPutOp(ctx context.Context, sourcePath string, targetPath string, length int64) PutOperation {
 	return PutOperation{
-		Source: sourcePath,
-		Target: targetPath,
-		Length: int64(length),
-		Operation: &Operation{
-			Error: make(chan error),
-		},
+		Source:    sourcePath,
+		Target:    targetPath,
+		Length:    int64(length),
+		Operation: newOperation(ctx),
+	}
+}
+
+// AppendOperation - Append bytes of source file to target object.
+type AppendOperation struct {
+	*Operation
+
+	// bytes of the source file to append, starting at Offset.
+	Offset int64
+	Length int64
+
+	Source string
+	Target string
+
+	// etag of the object appended to, set to the etag of the new object
+	// on success.
+	ETag string
+}
+
+func newAppendOp(ctx context.Context, sourcePath, targetPath string, offset, length int64, etag string) AppendOperation {
+	return AppendOperation{
+		Source:    sourcePath,
+		Target:    targetPath,
+		Offset:    offset,
+		Length:    length,
+		ETag:      etag,
+		Operation: newOperation(ctx),
 	}
 }
@@ -0,0 +1,78 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathRule applies a value to the files matching a pattern.
+type pathRule struct {
+	pattern string
+	re      *regexp.Regexp
+	value   string
+}
+
+// newPathRule returns a rule for the glob pattern, where * and ? match
+// within a path element and ** across elements. Patterns without a slash
+// match the name of files.
+func newPathRule(pattern, value string) pathRule {
+	expr := ""
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr += ".*"
+			i++
+		case pattern[i] == '*':
+			expr += "[^/]*"
+		case pattern[i] == '?':
+			expr += "[^/]"
+		default:
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+
+	return pathRule{
+		pattern: pattern,
+		re:      regexp.MustCompile("^" + expr + "$"),
+		value:   value,
+	}
+}
+
+// match returns true if the file at p matches the rule.
+func (rule pathRule) match(p string) bool {
+	if !strings.Contains(rule.pattern, "/") {
+		p = path.Base(p)
+	}
+	return rule.re.MatchString(p)
+}
+
+// matchRules returns the value of the first of rules matching the file
+// at p.
+func matchRules(rules []pathRule, p string) (string, bool) {
+	for _, rule := range rules {
+		if rule.match(p) {
+			return rule.value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,449 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// Files opened read-only are fetched in blocks when read, if read-ahead is
+// enabled. Blocks are the chunks of encrypted objects, so they can be
+// decrypted on their own.
+const sparseBlockSize = encChunkSize
+
+// initial read-ahead window, restored by random reads.
+const minReadAhead = 2 * sparseBlockSize
+
+// sparseFile tracks the fetched blocks of a cache file opened before its
+// content has been downloaded.
+type sparseFile struct {
+	m    sync.Mutex
+	cond *sync.Cond
+
+	// size of the content and etag of the object it is fetched from.
+	size int64
+	etag string
+
+	// cipher of the chunks of encrypted objects.
+	aead cipher.AEAD
+
+	// blocks fetched or being fetched, the number of blocks not fetched
+	// yet and of fetches in progress.
+	fetched  []bool
+	pending  []bool
+	missing  int
+	inflight int
+
+	// offset a sequential read continues at, the read-ahead window and
+	// the first block not read ahead yet.
+	next   int64
+	window int64
+	ahead  int64
+
+	// set once the cache file has been closed.
+	closed bool
+}
+
+// complete returns true if all blocks have been fetched.
+func (s *sparseFile) complete() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.missing == 0
+}
+
+// claim marks the blocks from first up to last which are neither fetched
+// nor pending as pending, stopping at the first one which is. Returns the
+// last claimed block, called with s.m held.
+func (s *sparseFile) claim(first, last int64) int64 {
+	end := first
+	for end < last && !s.fetched[end+1] && !s.pending[end+1] {
+		end++
+	}
+
+	for i := first; i <= end; i++ {
+		s.pending[i] = true
+	}
+	s.inflight++
+	return end
+}
+
+// finish marks the claimed blocks first to last as fetched, unless err is
+// set, called with s.m held.
+func (s *sparseFile) finish(first, last int64, err error) {
+	for i := first; i <= last; i++ {
+		s.pending[i] = false
+		if err == nil && !s.fetched[i] {
+			s.fetched[i] = true
+			s.missing--
+		}
+	}
+	s.inflight--
+	s.cond.Broadcast()
+}
+
+// lazy returns true if req opens f to read it only, fetching its content
+// when read.
+func (f *File) lazy(req *fuse.OpenRequest) bool {
+	if f.mfs.config.readAhead == 0 || !req.Flags.IsReadOnly() {
+		return false
+	}
+	return (f.ETag != "" || f.VersionID != "") && f.Size > 0
+}
+
+// openSparse opens a sparse cache file of the size of f, whose blocks are
+// fetched when read.
+func (f *File) openSparse(ctx context.Context) (*openFile, error) {
+	size := int64(f.Size)
+	if err := f.mfs.reserveCache(size); err != nil {
+		return nil, err
+	}
+
+	cachePath, err := f.mfs.NewCachePath()
+	if err != nil {
+		f.mfs.releaseCache(size)
+		return nil, err
+	}
+
+	of, err := openCacheFile(f, cachePath, os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		f.mfs.releaseCache(size)
+		return nil, err
+	}
+
+	blocks := (size + sparseBlockSize - 1) / sparseBlockSize
+	s := &sparseFile{
+		size:    size,
+		etag:    f.ETag,
+		fetched: make([]bool, blocks),
+		pending: make([]bool, blocks),
+		missing: int(blocks),
+		window:  minReadAhead,
+	}
+	s.cond = sync.NewCond(&s.m)
+	of.sparse = s
+
+	if err = of.Truncate(size); err == nil && f.mfs.encrypted() {
+		s.aead, err = of.fetchCipher(ctx)
+	}
+	if err != nil {
+		of.Close()
+		f.mfs.removeCacheFile(cachePath)
+		return nil, err
+	}
+	return of, nil
+}
+
+// fetchCipher returns the cipher of the chunks of the encrypted object,
+// with the salt from its header.
+func (of *openFile) fetchCipher(ctx context.Context) (cipher.AEAD, error) {
+	mfs := of.f.mfs
+	header := make([]byte, encHeaderSize)
+	if err := mfs.s3(ctx, "GetObject", of.f.RemotePath(), func() error {
+		object, err := mfs.getRange(ctx, of.f, of.sparse.etag, 0, int64(encHeaderSize)-1)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		_, err = io.ReadFull(object, header)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(string(header), encMagic) {
+		return nil, errNotEncrypted
+	}
+	return mfs.contentCipher(header[len(encMagic):])
+}
+
+// getRange returns the bytes from start to end of the object of f, or of
+// its version if set. Other objects are only read if their etag is etag.
+func (mfs *MinFS) getRange(ctx context.Context, f *File, etag string, start, end int64) (io.ReadCloser, error) {
+	remotePath := f.RemotePath()
+	if f.VersionID == "" {
+		reqHeaders := mfs.requestHeaders()
+		if err := reqHeaders.SetRange(start, end); err != nil {
+			return nil, err
+		}
+		if err := reqHeaders.SetMatchETag(etag); err != nil {
+			return nil, err
+		}
+
+		bucket, key := mfs.splitPath(remotePath)
+		object, _, err := minio.Core{Client: mfs.client(remotePath)}.GetObject(bucket, key, reqHeaders)
+		return object, err
+	}
+
+	header := http.Header{}
+	for k, v := range mfs.sseCHeaders() {
+		header.Set(k, v)
+	}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := mfs.request(ctx, "GET", remotePath, url.Values{"versionId": {f.VersionID}}, nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// fetchBlocks downloads the blocks first to last into the cache file.
+func (of *openFile) fetchBlocks(first, last int64) error {
+	mfs := of.f.mfs
+	s := of.sparse
+
+	blocks := int64(len(s.fetched))
+	start, end := first*sparseBlockSize, (last+1)*sparseBlockSize
+	if s.aead != nil {
+		start = int64(encHeaderSize) + first*(sparseBlockSize+encOverhead)
+		end = int64(encHeaderSize) + (last+1)*(sparseBlockSize+encOverhead)
+		if size := encryptedSize(s.size); end > size {
+			end = size
+		}
+	} else if end > s.size {
+		end = s.size
+	}
+
+	ctx := context.Background()
+	return mfs.s3(ctx, "GetObject", of.f.RemotePath(), func() error {
+		object, err := mfs.getRange(ctx, of.f, s.etag, start, end-1)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		r := mfs.downloadReader(ctx, object)
+		buf := make([]byte, sparseBlockSize+encOverhead)
+		for i := first; i <= last; i++ {
+			n := int64(sparseBlockSize)
+			if rest := s.size - i*sparseBlockSize; rest < n {
+				n = rest
+			}
+			if s.aead != nil {
+				n += encOverhead
+			}
+
+			if _, err = io.ReadFull(r, buf[:n]); err == io.EOF {
+				return io.ErrUnexpectedEOF
+			} else if err != nil {
+				return err
+			}
+			mfs.metrics.downloaded.Add(uint64(n))
+
+			data := buf[:n]
+			if s.aead != nil {
+				if data, err = s.aead.Open(data[:0], chunkNonce(uint64(i), i == blocks-1), data, nil); err != nil {
+					return err
+				}
+			}
+
+			if _, err = of.WriteAt(data, i*sparseBlockSize); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ensure fetches the blocks of the n bytes at off which haven't been
+// fetched yet, and reads ahead of sequential reads.
+func (of *openFile) ensure(off, n int64) error {
+	s := of.sparse
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.missing == 0 || off >= s.size || n == 0 {
+		return nil
+	}
+
+	end := off + n
+	if end > s.size {
+		end = s.size
+	}
+
+	// sequential reads grow the window, others shrink it back
+	sequential := off == s.next
+	if sequential {
+		s.window *= 2
+		if s.window > of.f.mfs.config.readAhead {
+			s.window = of.f.mfs.config.readAhead
+		}
+	} else {
+		s.window = minReadAhead
+		s.ahead = 0
+	}
+	s.next = end
+
+	first, last := off/sparseBlockSize, (end-1)/sparseBlockSize
+	if sequential {
+		of.readAhead(last + 1)
+	}
+	return of.fetchRange(first, last)
+}
+
+// fetchRange fetches the blocks first to last which haven't been fetched
+// yet, waiting for the ones being fetched, called with of.sparse.m held.
+func (of *openFile) fetchRange(first, last int64) error {
+	s := of.sparse
+	for i := first; i <= last; {
+		if s.fetched[i] {
+			i++
+			continue
+		} else if s.pending[i] {
+			s.cond.Wait()
+			continue
+		}
+
+		claimed := s.claim(i, last)
+		s.m.Unlock()
+		err := of.fetchBlocks(i, claimed)
+		s.m.Lock()
+		s.finish(i, claimed, err)
+
+		if err == errArchived && of.f.mfs.config.restoreDays > 0 {
+			of.f.requestRestore(context.Background())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAhead starts fetching the windows after block from in the
+// background, called with of.sparse.m held.
+func (of *openFile) readAhead(from int64) {
+	s := of.sparse
+	blocks := int64(len(s.fetched))
+	window := s.window / sparseBlockSize
+
+	limit := from + window*int64(of.f.mfs.config.readAheadWorkers)
+	if limit > blocks {
+		limit = blocks
+	}
+
+	if s.ahead < from {
+		s.ahead = from
+	}
+	for s.ahead < limit {
+		first, last := s.ahead, s.ahead+window-1
+		if last >= limit {
+			last = limit - 1
+		}
+		s.ahead = last + 1
+
+		go of.prefetch(first, last)
+	}
+}
+
+// prefetch fetches the blocks first to last which haven't been fetched
+// yet, waiting for a free read-ahead worker first.
+func (of *openFile) prefetch(first, last int64) {
+	mfs := of.f.mfs
+	mfs.readAhead <- struct{}{}
+	defer func() { <-mfs.readAhead }()
+
+	s := of.sparse
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for first <= last && !s.closed {
+		if s.fetched[first] || s.pending[first] {
+			first++
+			continue
+		}
+
+		claimed := s.claim(first, last)
+		s.m.Unlock()
+		err := of.fetchBlocks(first, claimed)
+		s.m.Lock()
+		s.finish(first, claimed, err)
+
+		if err != nil && !s.closed {
+			mfs.log.Warnf("Unable to read ahead %s: %s\n", of.f.FullPath(), err)
+			return
+		}
+		first = claimed + 1
+	}
+}
+
+// fill fetches all blocks not fetched yet, before the cache file is
+// changed.
+func (of *openFile) fill() error {
+	if of.sparse == nil {
+		return nil
+	}
+
+	s := of.sparse
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.missing == 0 {
+		return nil
+	}
+	return of.fetchRange(0, int64(len(s.fetched))-1)
+}
+
+// settle waits for the fetches in progress and marks all blocks as
+// fetched, before the cache file is truncated completely.
+func (of *openFile) settle() {
+	if of.sparse == nil {
+		return
+	}
+
+	s := of.sparse
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for s.inflight > 0 {
+		s.cond.Wait()
+	}
+	for i := range s.fetched {
+		s.fetched[i] = true
+	}
+	s.missing = 0
+}
+
+// closeSparse stops reading ahead into the cache file, which is about to
+// be closed.
+func (of *openFile) closeSparse() {
+	if of.sparse == nil {
+		return
+	}
+
+	of.sparse.m.Lock()
+	of.sparse.closed = true
+	of.sparse.m.Unlock()
+}
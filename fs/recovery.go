@@ -0,0 +1,181 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	"golang.org/x/net/context"
+)
+
+// Policies for dirty cache files left from a previous run.
+const (
+	// upload the changes, unless the object has been changed meanwhile.
+	RecoverUpload = "upload"
+	// upload the changes below the lost+found prefix.
+	RecoverLostFound = "lostfound"
+	// remove the changes.
+	RecoverDiscard = "discard"
+)
+
+// prefix below the mount path receiving recovered files.
+const lostFoundPrefix = "lost+found"
+
+var _ = meta.RegisterExt(3, dirtyFile{})
+
+// dirtyFile records a cache file with changes not yet uploaded.
+type dirtyFile struct {
+	CachePath  string
+	RemotePath string
+
+	// etag of the object the changes are based on.
+	ETag string
+
+	// bytes of the object before the cache file, if it holds only bytes
+	// appended to it, of which Appended have been appended already.
+	Base     int64
+	Appended int64
+
+	Mtime time.Time
+}
+
+func dirtyBucket(tx *meta.Tx) *meta.Bucket {
+	return tx.Bucket("dirty/")
+}
+
+// recordDirty records the cache file of the open file as dirty.
+func (of *openFile) recordDirty(tx *meta.Tx) error {
+	of.baseM.RLock()
+	defer of.baseM.RUnlock()
+
+	return dirtyBucket(tx).Put(path.Base(of.cachePath), dirtyFile{
+		CachePath:  of.cachePath,
+		RemotePath: of.f.RemotePath(),
+		ETag:       of.f.ETag,
+		Base:       of.base,
+		Appended:   of.appended,
+		Mtime:      time.Now().UTC(),
+	})
+}
+
+// clearDirty removes the dirty record of the cache file of the open file.
+func (of *openFile) clearDirty(tx *meta.Tx) error {
+	return dirtyBucket(tx).Delete(path.Base(of.cachePath))
+}
+
+// recover applies the configured policy to all dirty cache files left
+// from a previous run.
+func (mfs *MinFS) recover() error {
+	files := map[string]dirtyFile{}
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return dirtyBucket(tx).ForEach(func(k string, o interface{}) error {
+			if df, ok := o.(dirtyFile); ok {
+				files[k] = df
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for k, df := range files {
+		if err := mfs.recoverFile(df); err != nil {
+			mfs.log.Errorf("Unable to recover %s from %s: %s\n", df.RemotePath, df.CachePath, err)
+			continue
+		}
+
+		if err := mfs.db.Update(func(tx *meta.Tx) error {
+			return dirtyBucket(tx).Delete(k)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverFile applies the configured policy to a single dirty file.
+func (mfs *MinFS) recoverFile(df dirtyFile) error {
+	fi, err := os.Stat(df.CachePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	policy := mfs.config.recoverPolicy
+	if policy == RecoverUpload && mfs.changedSince(df.RemotePath, df.ETag) {
+		mfs.log.Warnf("%s has been changed meanwhile, recovering below %s.\n", df.RemotePath, lostFoundPrefix)
+		policy = RecoverLostFound
+	}
+
+	switch policy {
+	case RecoverUpload:
+		if df.Base > 0 {
+			ar := newAppendOp(context.Background(), df.CachePath, df.RemotePath, df.Appended, fi.Size()-df.Appended, df.ETag)
+			if err = mfs.appendOp(&ar); err != nil {
+				return err
+			}
+		} else {
+			sr := newPutOp(context.Background(), df.CachePath, df.RemotePath, fi.Size())
+			if err = mfs.putOp(&sr); err != nil {
+				return err
+			}
+		}
+		mfs.log.Printf("Recovered %s.\n", df.RemotePath)
+	case RecoverLostFound:
+		// of appends, only the appended bytes are recovered
+		target := mfs.lostFoundPath(df.RemotePath, df.Mtime)
+		sr := newPutOp(context.Background(), df.CachePath, target, fi.Size())
+		if err = mfs.putOp(&sr); err != nil {
+			return err
+		}
+		mfs.log.Printf("Recovered %s to %s.\n", df.RemotePath, target)
+	case RecoverDiscard:
+		mfs.log.Printf("Discarded changes of %s.\n", df.RemotePath)
+	}
+
+	return mfs.removeCacheFile(df.CachePath)
+}
+
+// changedSince returns true if the object at remotePath is not the object
+// with etag anymore, the changes of a cache file were based on.
+func (mfs *MinFS) changedSince(remotePath, etag string) bool {
+	objInfo, err := mfs.statObject(context.Background(), remotePath)
+	if err == fuse.ENOENT {
+		return etag != ""
+	} else if err != nil {
+		return true
+	}
+	return objInfo.ETag != etag
+}
+
+// lostFoundPath returns the path below lost+found receiving the changes
+// to remotePath made at mtime.
+func (mfs *MinFS) lostFoundPath(remotePath string, mtime time.Time) string {
+	rel := mfs.mountPath(remotePath) + "." + mtime.Format("20060102T150405Z")
+	if mfs.allBuckets() || mfs.isUnion() && !mfs.layered() {
+		// below the lost+found prefix of the bucket or source
+		bucket, key := mfs.splitRoot(rel)
+		return mfs.remotePath(path.Join(bucket, lostFoundPrefix, key))
+	}
+	return mfs.remotePath(path.Join(lostFoundPrefix, rel))
+}
@@ -0,0 +1,199 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// newTestFS returns a MinFS of the bucket "bucket" served by handler,
+// with a cache database in a temporary directory.
+func newTestFS(t *testing.T, handler http.Handler) (*MinFS, func()) {
+	dir, err := ioutil.TempDir("", "minfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+
+	cleanup := func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	mfs := &MinFS{
+		config: &Config{
+			target:        target,
+			accessKey:     "access",
+			secretKey:     "secret",
+			bucket:        "bucket",
+			cache:         dir,
+			renameWorkers: 2,
+			debug:         map[string]bool{},
+		},
+		handles:   newHandleTable(),
+		fileLocks: newLockManager(),
+		log:       log,
+	}
+	mfs.ctx, mfs.cancel = context.WithCancel(context.Background())
+	mfs.metrics = newMetrics(mfs)
+
+	if mfs.api, err = minio.NewWithRegion(strings.TrimPrefix(server.URL, "http://"), "access", "secret", false, "us-east-1"); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	mfs.transport = &reloadTransport{}
+	mfs.transport.store(&http.Transport{})
+	mfs.api.SetCustomTransport(mfs.transport)
+
+	if mfs.db, err = meta.Open(mfs.dbPath(), 0600, nil); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err = mfs.db.Update(func(tx *meta.Tx) error {
+		for _, name := range []string{"dirty/", "journal/", "cache/", "renames/", "keys/"} {
+			if _, berr := tx.CreateBucketIfNotExists([]byte(name)); berr != nil {
+				return berr
+			}
+		}
+		return nil
+	}); err != nil {
+		mfs.db.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return mfs, func() {
+		mfs.cancel()
+		mfs.db.Close()
+		cleanup()
+	}
+}
+
+func TestRenameEntryTarget(t *testing.T) {
+	entry := renameEntry{Source: "a/b", Target: "c"}
+
+	testCases := []struct {
+		key, target string
+	}{
+		{"a/b/x", "c/x"},
+		{"a/b/x/y", "c/x/y"},
+		{"a/b/", "c/"},
+	}
+
+	for i, testCase := range testCases {
+		if target := entry.target(testCase.key); target != testCase.target {
+			t.Errorf("Test %d: Expected target %s of %s, got %s", i+1, testCase.target, testCase.key, target)
+		}
+	}
+}
+
+func TestResumeRenames(t *testing.T) {
+	var (
+		m       sync.Mutex
+		removed []string
+	)
+	mfs, cleanup := newTestFS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		m.Lock()
+		removed = append(removed, strings.TrimPrefix(r.URL.Path, "/bucket/"))
+		m.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer cleanup()
+
+	// copied renames are finished, others are rolled back
+	for _, entry := range []renameEntry{
+		{Source: "a", Target: "b", Keys: []string{"a/x", "a/y/z"}, Copied: true},
+		{Source: "c", Target: "d", Keys: []string{"c/x"}},
+	} {
+		if err := mfs.putRename(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mfs.resumeRenames(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(removed)
+	if expected := []string{"a/x", "a/y/z", "d/x"}; strings.Join(removed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v to be removed, got %v", expected, removed)
+	}
+
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return renameBucket(tx).ForEach(func(k string, o interface{}) error {
+			t.Errorf("Expected rename of %s to be removed from the journal", k)
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenamePrefixRefused(t *testing.T) {
+	mfs, cleanup := newTestFS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the target is the only prefix which isn't empty
+		w.Header().Set("Content-Type", "application/xml")
+		if r.URL.Query().Get("prefix") != "target/" {
+			w.Write([]byte(`<ListBucketResult><Name>bucket</Name><KeyCount>0</KeyCount><IsTruncated>false</IsTruncated></ListBucketResult>`))
+			return
+		}
+		w.Write([]byte(`<ListBucketResult><Name>bucket</Name><KeyCount>1</KeyCount><IsTruncated>false</IsTruncated><Contents><Key>target/x</Key><Size>1</Size></Contents></ListBucketResult>`))
+	}))
+	defer cleanup()
+
+	if err := mfs.renamePrefix(context.Background(), "source", "target"); err != errNotEmpty {
+		t.Fatalf("Expected renaming over a directory which isn't empty to fail with %v, got %v", errNotEmpty, err)
+	}
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		return journalBucket(tx).Put("1", journalEntry{RemotePath: path.Join("source", "x")})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.renamePrefix(context.Background(), "source", "other"); err != errPending {
+		t.Fatalf("Expected renaming a directory with journaled uploads to fail with %v, got %v", errPending, err)
+	}
+	if err := mfs.renamePrefix(context.Background(), "sourcex", "other"); err != nil {
+		t.Fatalf("Expected renaming a directory without uploads below it to succeed, got %v", err)
+	}
+}
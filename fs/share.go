@@ -0,0 +1,113 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// name of the virtual extended attribute with a presigned url of a file.
+const presignedURLXattr = "user.s3.presigned_url"
+
+// maximum validity of presigned urls.
+const maxShareExpiry = 7 * 24 * time.Hour
+
+// errNotShareable is returned for files which can't be read through a
+// presigned url.
+var errNotShareable = fuse.Errno(syscall.ENOTSUP)
+
+// shareURL returns a presigned url reading the object at remotePath, or
+// its version versionID if set, valid for expires or the configured
+// expiry if zero.
+func (mfs *MinFS) shareURL(ctx context.Context, remotePath, versionID string, expires time.Duration) (string, error) {
+	// the url would hand out ciphertext, or require the customer key
+	if mfs.encrypted() || mfs.config.sse == SSEC {
+		return "", errNotShareable
+	}
+
+	if expires == 0 {
+		expires = mfs.config.shareExpiry
+	} else if expires < time.Second || expires > maxShareExpiry {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+
+	params := url.Values{}
+	if versionID != "" {
+		params.Set("versionId", versionID)
+	}
+
+	var u *url.URL
+	if err := mfs.s3(ctx, "PresignedGetObject", remotePath, func() (err error) {
+		u, err = mfs.presign("GET", remotePath, params, expires)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// share returns a presigned url of the file at p within the mount.
+func (mfs *MinFS) share(ctx context.Context, p string, expires time.Duration) (string, error) {
+	p = path.Clean("/" + p)[1:]
+	if p == "" {
+		return "", fuse.Errno(syscall.EISDIR)
+	}
+
+	remotePath := mfs.remotePath(p)
+	if mfs.config.asOf.IsZero() {
+		if _, err := mfs.statObject(ctx, remotePath); err != nil {
+			return "", err
+		}
+		return mfs.shareURL(ctx, remotePath, "", expires)
+	}
+
+	latest, _, err := mfs.latestVersions(ctx, remotePath, false)
+	if err != nil {
+		return "", err
+	}
+
+	version, ok := latest[remotePath]
+	if !ok || version.DeleteMarker {
+		return "", fuse.ENOENT
+	}
+	return mfs.shareURL(ctx, remotePath, version.VersionID, expires)
+}
+
+// Getxattr returns a presigned url of the file as its virtual attribute
+// user.s3.presigned_url.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	t := f.mfs.trace(subsystemFuse, "getxattr", f.FullPath())
+	defer t.done(&err)
+
+	if req.Name != presignedURLXattr {
+		return fuse.ErrNoXattr
+	}
+
+	u, err := f.mfs.shareURL(ctx, f.RemotePath(), f.VersionID, 0)
+	if err != nil {
+		return err
+	}
+
+	resp.Xattr = []byte(u)
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// errShuttingDown is returned for opens during shutdown.
+var errShuttingDown = fuse.Errno(syscall.ESHUTDOWN)
+
+// isDraining returns true once shutdown has started.
+func (mfs *MinFS) isDraining() bool {
+	return atomic.LoadInt32(&mfs.draining) == 1
+}
+
+// shutdown stops accepting new opens, drains pending uploads, closes the
+// cache database and unmounts. Only the first call has any effect, later
+// calls wait for it to finish.
+func (mfs *MinFS) shutdown() error {
+	mfs.shutdownOnce.Do(func() {
+		atomic.StoreInt32(&mfs.draining, 1)
+
+		if mfs.db != nil {
+			mfs.log.Println("Draining pending uploads...")
+			mfs.drain(mfs.config.shutdownTimeout)
+
+			if err := mfs.db.Close(); err != nil {
+				mfs.log.Errorln("Unable to close cache database.", err)
+			}
+		}
+
+		mfs.shutdownErr = fuse.Unmount(mfs.config.mountpoint)
+		mfs.log.Println("MinFS stopped cleanly.")
+	})
+	return mfs.shutdownErr
+}
+
+// drain flushes all dirty open files and waits for the sync queue to become
+// empty, at most for timeout. Uploads still in progress then are
+// interrupted, and drain returns once the flushes have given up. Unfinished
+// work is logged.
+func (mfs *MinFS) drain(timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	files := mfs.handles.openFiles()
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for _, of := range files {
+			if err := of.flush(mfs.ctx); err != nil {
+				mfs.log.Errorf("Unable to flush %s: %s\n", of.f.FullPath(), err)
+			}
+			of.releaseLease(mfs.ctx)
+		}
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for doneCh != nil || atomic.LoadInt64(&mfs.queued) > 0 {
+		select {
+		case <-doneCh:
+			doneCh = nil
+		case <-ticker.C:
+		case <-deadline:
+			mfs.log.Warnf("Shutdown timeout of %s exceeded, %d sync operations unfinished.\n", timeout, atomic.LoadInt64(&mfs.queued))
+			mfs.cancel()
+
+			// the cache database is closed once the flushes have
+			// given up
+			if doneCh != nil {
+				<-doneCh
+			}
+			mfs.logUnfinished(files)
+			return
+		}
+	}
+
+	mfs.logUnfinished(files)
+}
+
+// logUnfinished logs open files which are still dirty and removes the
+// cache files of the others, which won't be released anymore.
+func (mfs *MinFS) logUnfinished(files []*openFile) {
+	for _, of := range files {
+		if of.isDirty() {
+			mfs.log.Warnf("Unfinished upload of %s, changes are kept in %s.\n", of.f.FullPath(), of.cachePath)
+			continue
+		}
+		mfs.removeCache(of.cachePath)
+	}
+}
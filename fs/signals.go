@@ -47,3 +47,11 @@ func signalTrap(sig ...os.Signal) <-chan bool {
 
 	return trapCh
 }
+
+// signalNotify relays every occurrence of the registered signals until
+// signal.Stop is called with the returned channel.
+func signalNotify(sig ...os.Signal) chan os.Signal {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, sig...)
+	return sigCh
+}
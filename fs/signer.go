@@ -0,0 +1,226 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/s3signer"
+	"github.com/minio/minio-go/pkg/s3utils"
+	"golang.org/x/net/context"
+)
+
+// payload hash of bodies which aren't signed.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// endpoint is the url and the credentials of an S3 endpoint.
+type endpoint struct {
+	target                url.URL
+	access, secret, token string
+}
+
+// endpoint returns the endpoint of remotePath, the one of its union source
+// if set.
+func (mfs *MinFS) endpoint(remotePath string) endpoint {
+	root, _ := mfs.splitRoot(remotePath)
+	if src := mfs.source(root); src != nil {
+		return mfs.sourceEndpoint(src)
+	}
+	return endpoint{
+		target: *mfs.config.target,
+		access: mfs.config.accessKey,
+		secret: mfs.config.secretKey,
+		token:  mfs.config.secretToken,
+	}
+}
+
+// sourceEndpoint returns the endpoint of the union source src, which
+// defaults to the target and the credentials of the mount.
+func (mfs *MinFS) sourceEndpoint(src *UnionSource) endpoint {
+	ep := endpoint{
+		target: *mfs.config.target,
+		access: src.AccessKey,
+		secret: src.SecretKey,
+		token:  src.SecretToken,
+	}
+	if src.target.Host != "" {
+		ep.target = *src.target
+	}
+	if ep.access == "" {
+		ep.access, ep.secret, ep.token = mfs.config.accessKey, mfs.config.secretKey, mfs.config.secretToken
+	}
+	return ep
+}
+
+// anonymous returns true if requests to the endpoint aren't signed.
+func (ep endpoint) anonymous() bool {
+	return ep.access == "" || ep.secret == ""
+}
+
+// url returns the url of object in bucket in the region location, in the
+// same style the api client uses.
+func (ep endpoint) url(bucket, object, location string, params url.Values) (*url.URL, error) {
+	host := ep.target.Host
+	if s3utils.IsAmazonEndpoint(ep.target) && !s3utils.IsAmazonFIPSGovCloudEndpoint(ep.target) &&
+		!s3utils.IsAmazonChinaEndpoint(ep.target) && location != "" && location != "us-east-1" {
+		host = "s3." + location + ".amazonaws.com"
+	}
+
+	// the signature covers the host, which must not carry the default port
+	scheme := ep.target.Scheme
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		if scheme == "http" && p == "80" || scheme == "https" && p == "443" {
+			host = h
+		}
+	}
+
+	urlStr := scheme + "://" + host + "/"
+	if bucket != "" {
+		if s3utils.IsVirtualHostSupported(ep.target, bucket) {
+			urlStr = scheme + "://" + bucket + "." + host + "/"
+		} else {
+			urlStr = urlStr + bucket + "/"
+		}
+		urlStr = urlStr + s3utils.EncodePath(object)
+	}
+
+	if len(params) > 0 {
+		urlStr = urlStr + "?" + s3utils.QueryEncode(params)
+	}
+	return url.Parse(urlStr)
+}
+
+// location returns the region of bucket at the endpoint of remotePath.
+func (mfs *MinFS) location(remotePath, bucket string) (string, error) {
+	if bucket == "" {
+		return "us-east-1", nil
+	}
+
+	location, err := mfs.client(remotePath).GetBucketLocation(bucket)
+	if err != nil && minio.ToErrorResponse(err).Code != "AccessDenied" {
+		return "", err
+	} else if location == "" {
+		// the location may not be readable with the credentials
+		location = "us-east-1"
+	}
+	return location, nil
+}
+
+// requestURL returns the url of key, the endpoint and the region of its
+// bucket.
+func (mfs *MinFS) requestURL(key string, params url.Values) (*url.URL, endpoint, string, error) {
+	ep := mfs.endpoint(key)
+	bucket, object := mfs.splitPath(key)
+	location, err := mfs.location(key, bucket)
+	if err != nil {
+		return nil, ep, "", err
+	}
+
+	u, err := ep.url(bucket, object, location, params)
+	return u, ep, location, err
+}
+
+// newRequest returns the request method on key, on its bucket if the key
+// is empty, signed with the credentials of its endpoint. The body is signed
+// with its sha256 sum if set, otherwise it is streamed, with chunk
+// signatures over plain http.
+func (mfs *MinFS) newRequest(ctx context.Context, method, key string, params url.Values, body io.Reader, length int64, sum []byte, header http.Header) (*http.Request, error) {
+	u, ep, location, err := mfs.requestURL(key, params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	// the transport would close the cache file being uploaded
+	if length > 0 {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = length
+	}
+	req = req.WithContext(ctx)
+
+	if ep.anonymous() {
+		return req, nil
+	}
+
+	if sum == nil && ep.target.Scheme == "http" && length > 0 {
+		return s3signer.StreamingSignV4(req, ep.access, ep.secret, ep.token, location, length, time.Now().UTC()), nil
+	}
+
+	payload := unsignedPayload
+	if sum != nil {
+		payload = hex.EncodeToString(sum)
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	return s3signer.SignV4(*req, ep.access, ep.secret, ep.token, location), nil
+}
+
+// presign returns the url of the request method on key, signed with the
+// credentials of its endpoint and valid for expires.
+func (mfs *MinFS) presign(method, key string, params url.Values, expires time.Duration) (*url.URL, error) {
+	u, ep, location, err := mfs.requestURL(key, params)
+	if err != nil {
+		return nil, err
+	} else if ep.anonymous() {
+		return nil, errors.New("Presigned urls require credentials")
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return s3signer.PreSignV4(*req, ep.access, ep.secret, ep.token, location, int64(expires/time.Second)).URL, nil
+}
+
+// request performs the S3 request method on key, for requests not
+// supported by the api client. Requests on the bucket have an empty key.
+func (mfs *MinFS) request(ctx context.Context, method, key string, params url.Values, body []byte, header http.Header) (*http.Response, error) {
+	sum := sha256.Sum256(body)
+	req, err := mfs.newRequest(ctx, method, key, params, bytes.NewReader(body), int64(len(body)), sum[:], header)
+	if err != nil {
+		return nil, err
+	}
+	return mfs.do(req)
+}
+
+// do sends req through the transport of the mount.
+func (mfs *MinFS) do(req *http.Request) (*http.Response, error) {
+	client := &http.Client{
+		Transport: mfs.transport,
+		// redirects would have to be signed again
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,105 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestEndpointURL(t *testing.T) {
+	testCases := []struct {
+		target   string
+		bucket   string
+		object   string
+		location string
+		params   url.Values
+		expected string
+	}{
+		{"http://localhost:9000", "bucket", "a b/c", "us-east-1", nil, "http://localhost:9000/bucket/a%20b/c"},
+		{"http://localhost:80", "bucket", "", "us-east-1", url.Values{"versions": {""}}, "http://localhost/bucket/?versions="},
+		{"https://s3.amazonaws.com", "bucket", "key", "us-east-1", nil, "https://bucket.s3.amazonaws.com/key"},
+		{"https://s3.amazonaws.com", "bucket", "key", "eu-west-1", nil, "https://bucket.s3.eu-west-1.amazonaws.com/key"},
+		{"https://s3.amazonaws.com", "", "", "us-east-1", nil, "https://s3.amazonaws.com/"},
+	}
+
+	for i, testCase := range testCases {
+		target, err := url.Parse(testCase.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u, err := endpoint{target: *target}.url(testCase.bucket, testCase.object, testCase.location, testCase.params)
+		if err != nil {
+			t.Fatalf("Test %d: %s", i+1, err)
+		}
+		if u.String() != testCase.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i+1, testCase.expected, u)
+		}
+	}
+}
+
+func TestRequestSigned(t *testing.T) {
+	var (
+		path, query, auth, sum string
+	)
+	mfs, cleanup := newTestFS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.Path, r.URL.RawQuery
+		auth, sum = r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+	}))
+	defer cleanup()
+
+	resp, err := mfs.request(context.Background(), "GET", "", url.Values{"versions": {""}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if path != "/bucket/" || query != "versions=" {
+		t.Errorf("Expected the request on the bucket, got %s?%s", path, query)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") {
+		t.Errorf("Expected a v4 signature, got %q", auth)
+	}
+	// sha256 of the empty body
+	if sum != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("Expected the signed payload hash, got %q", sum)
+	}
+}
+
+func TestPresign(t *testing.T) {
+	mfs, cleanup := newTestFS(t, http.NotFoundHandler())
+	defer cleanup()
+
+	u, err := mfs.presign("GET", "key", url.Values{"versionId": {"v1"}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := u.Query()
+	if u.Path != "/bucket/key" || query.Get("versionId") != "v1" {
+		t.Errorf("Expected the url of the version, got %s", u)
+	}
+	if query.Get("X-Amz-Expires") != "3600" || query.Get("X-Amz-Signature") == "" {
+		t.Errorf("Expected a signature valid for an hour, got %s", u)
+	}
+}
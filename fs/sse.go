@@ -0,0 +1,96 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// Server side encryption modes.
+const (
+	// keys managed by the server.
+	SSES3 = "s3"
+	// keys managed by a key management service.
+	SSEKMS = "kms"
+	// keys provided by the client with every request.
+	SSEC = "c"
+)
+
+// sseCHeaders returns the headers carrying the customer provided key.
+func (mfs *MinFS) sseCHeaders() map[string]string {
+	if mfs.config.sse != SSEC {
+		return nil
+	}
+
+	sum := md5.Sum(mfs.config.sseCKey)
+	return map[string]string{
+		"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+		"X-Amz-Server-Side-Encryption-Customer-Key":       base64.StdEncoding.EncodeToString(mfs.config.sseCKey),
+		"X-Amz-Server-Side-Encryption-Customer-Key-MD5":   base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+// sseHeaders returns the headers requesting encryption of uploads.
+func (mfs *MinFS) sseHeaders() map[string]string {
+	switch mfs.config.sse {
+	case SSES3:
+		return map[string]string{
+			"X-Amz-Server-Side-Encryption": "AES256",
+		}
+	case SSEKMS:
+		headers := map[string]string{
+			"X-Amz-Server-Side-Encryption": "aws:kms",
+		}
+		if mfs.config.sseKMSKeyID != "" {
+			headers["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = mfs.config.sseKMSKeyID
+		}
+		return headers
+	case SSEC:
+		return mfs.sseCHeaders()
+	}
+	return nil
+}
+
+// requestHeaders returns the headers of requests reading objects.
+func (mfs *MinFS) requestHeaders() minio.RequestHeaders {
+	reqHeaders := minio.NewGetReqHeaders()
+	for k, v := range mfs.sseCHeaders() {
+		reqHeaders.Set(k, v)
+	}
+	return reqHeaders
+}
+
+// getObject returns the content of the object at path.
+func (mfs *MinFS) getObject(path string) (io.ReadCloser, minio.ObjectInfo, error) {
+	bucket, key := mfs.splitPath(path)
+	return minio.Core{Client: mfs.client(path)}.GetObject(bucket, key, mfs.requestHeaders())
+}
+
+// statObject returns the info of the object at path.
+func (mfs *MinFS) statObject(ctx context.Context, path string) (objInfo minio.ObjectInfo, err error) {
+	err = mfs.s3(ctx, "StatObject", path, func() (serr error) {
+		bucket, key := mfs.splitPath(path)
+		objInfo, serr = minio.Core{Client: mfs.client(path)}.StatObject(bucket, key, mfs.requestHeaders())
+		return serr
+	})
+	return objInfo, err
+}
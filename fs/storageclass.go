@@ -0,0 +1,79 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// header selecting the storage class of uploads.
+const storageClassHeader = "X-Amz-Storage-Class"
+
+// errArchived is returned when reading an object which has been archived
+// and has to be restored first.
+var errArchived = fuse.Errno(syscall.ENODATA)
+
+// storageClass returns the storage class of uploads to remotePath, the
+// class of the first matching rule or the class of the mount.
+func (mfs *MinFS) storageClass(remotePath string) string {
+	if class, ok := matchRules(mfs.config.storageRules, mfs.mountPath(remotePath)); ok {
+		return class
+	}
+	return mfs.config.storageClass
+}
+
+// objectHeaders returns the headers of uploads to remotePath.
+func (mfs *MinFS) objectHeaders(remotePath string) map[string]string {
+	headers := map[string]string{}
+	for k, v := range mfs.sseHeaders() {
+		headers[k] = v
+	}
+	if class := mfs.storageClass(remotePath); class != "" {
+		headers[storageClassHeader] = class
+	}
+	return headers
+}
+
+// restoreObject requests a temporary copy of the archived object at
+// remotePath, readable once the restore has completed.
+func (mfs *MinFS) restoreObject(ctx context.Context, remotePath string) error {
+	body := fmt.Sprintf("<RestoreRequest><Days>%d</Days></RestoreRequest>", mfs.config.restoreDays)
+
+	return mfs.s3(ctx, "RestoreObject", remotePath, func() error {
+		resp, err := mfs.request(ctx, "POST", remotePath, url.Values{"restore": {""}}, []byte(body), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusAccepted:
+			// restored already, or restore started
+			return nil
+		case http.StatusConflict:
+			// restore in progress
+			return nil
+		}
+		return responseError(resp)
+	})
+}
@@ -0,0 +1,253 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// bytes passed at once by throttled readers, keeping the waits short.
+const throttleChunk = 32 * 1024
+
+// rateLimiter is a token bucket passing rate bytes per second, with a
+// burst of one second. A zero rate is unlimited.
+type rateLimiter struct {
+	m      sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the rate of the limiter.
+func (l *rateLimiter) setRate(rate int64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if rate != l.rate {
+		l.rate = rate
+		l.tokens = 0
+		l.last = time.Now()
+	}
+}
+
+// getRate returns the rate of the limiter.
+func (l *rateLimiter) getRate() int64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.rate
+}
+
+// wait blocks until n bytes may pass, or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.m.Lock()
+	if l.rate <= 0 {
+		l.m.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+
+	// the bytes are passed on credit, later callers wait for them
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.m.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return fuse.EINTR
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader reads from r at the rate of its limiter.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+
+	n, err := r.r.Read(p)
+	if werr := r.limiter.wait(r.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// throttledReaderAt is a throttledReader of an io.ReaderAt, which keeps
+// the parallel upload of parts possible.
+type throttledReaderAt struct {
+	throttledReader
+	ra io.ReaderAt
+}
+
+func (r *throttledReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && err == nil {
+		end := n + throttleChunk
+		if end > len(p) {
+			end = len(p)
+		}
+
+		var m int
+		m, err = r.ra.ReadAt(p[n:end], off+int64(n))
+		n += m
+		if werr := r.limiter.wait(r.ctx, m); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// throttled returns r read at the rate of limiter until ctx is done, or r
+// itself if the rate is unlimited when the transfer starts.
+func throttled(ctx context.Context, r io.Reader, limiter *rateLimiter) io.Reader {
+	if limiter.getRate() <= 0 {
+		return r
+	}
+
+	tr := throttledReader{ctx: ctx, r: r, limiter: limiter}
+	if ra, ok := r.(io.ReaderAt); ok {
+		return &throttledReaderAt{throttledReader: tr, ra: ra}
+	}
+	return &tr
+}
+
+// rateWindow - limits of uploads and downloads between two times of day,
+// in bytes per second.
+type rateWindow struct {
+	from, to         time.Duration
+	upload, download int64
+}
+
+// contains returns true if the time of day of t is within the window,
+// which may span midnight.
+func (w rateWindow) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.from <= w.to {
+		return d >= w.from && d < w.to
+	}
+	return d >= w.from || d < w.to
+}
+
+// throttle limits the bandwidth of uploads and downloads.
+type throttle struct {
+	uploads   rateLimiter
+	downloads rateLimiter
+
+	m sync.Mutex
+
+	// limits outside of the scheduled windows, adjustable at runtime.
+	upload   int64
+	download int64
+
+	schedule []rateWindow
+}
+
+// newThrottle returns the throttle of the configured limits.
+func newThrottle(cfg *Config) *throttle {
+	t := &throttle{
+		upload:   cfg.maxUploadRate,
+		download: cfg.maxDownloadRate,
+		schedule: cfg.rateSchedule,
+	}
+	t.apply(time.Now())
+	return t
+}
+
+// apply sets the limits in effect at now, of the first window containing
+// it.
+func (t *throttle) apply(now time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	upload, download := t.upload, t.download
+	for _, w := range t.schedule {
+		if w.contains(now) {
+			upload, download = w.upload, w.download
+			break
+		}
+	}
+
+	t.uploads.setRate(upload)
+	t.downloads.setRate(download)
+}
+
+// set changes the limits outside of the scheduled windows, negative
+// limits are left unchanged.
+func (t *throttle) set(upload, download int64) {
+	t.m.Lock()
+	if upload >= 0 {
+		t.upload = upload
+	}
+	if download >= 0 {
+		t.download = download
+	}
+	t.m.Unlock()
+
+	t.apply(time.Now())
+}
+
+// uploadReader returns r, read at the upload rate until ctx is done.
+func (mfs *MinFS) uploadReader(ctx context.Context, r io.Reader) io.Reader {
+	return throttled(ctx, r, &mfs.throttle.uploads)
+}
+
+// downloadReader returns r, read at the download rate until ctx is done.
+func (mfs *MinFS) downloadReader(ctx context.Context, r io.Reader) io.Reader {
+	return throttled(ctx, r, &mfs.throttle.downloads)
+}
+
+// startSchedule applies the limits of the scheduled windows every minute,
+// until doneCh is closed.
+func (mfs *MinFS) startSchedule(doneCh <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-doneCh:
+				return
+			case now := <-ticker.C:
+				mfs.throttle.apply(now)
+			}
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRateWindowContains(t *testing.T) {
+	day := rateWindow{from: 9 * time.Hour, to: 17 * time.Hour}
+	night := rateWindow{from: 22 * time.Hour, to: 6*time.Hour + 30*time.Minute}
+
+	testCases := []struct {
+		w        rateWindow
+		hour     int
+		minute   int
+		contains bool
+	}{
+		{day, 8, 59, false},
+		{day, 9, 0, true},
+		{day, 16, 59, true},
+		{day, 17, 0, false},
+		// windows spanning midnight
+		{night, 21, 59, false},
+		{night, 22, 0, true},
+		{night, 23, 59, true},
+		{night, 0, 0, true},
+		{night, 6, 29, true},
+		{night, 6, 30, false},
+		{night, 12, 0, false},
+	}
+
+	for i, testCase := range testCases {
+		now := time.Date(2017, 3, 1, testCase.hour, testCase.minute, 30, 0, time.Local)
+		if contains := testCase.w.contains(now); contains != testCase.contains {
+			t.Errorf("Test %d: Expected contains(%02d:%02d) %v, got %v", i+1, testCase.hour, testCase.minute, testCase.contains, contains)
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	var l rateLimiter
+
+	// unlimited
+	if err := l.wait(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+
+	l.setRate(1000)
+
+	// the limiter starts without credit, each call waits for its bytes
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if err := l.wait(context.Background(), 100); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 80*time.Millisecond || d > 500*time.Millisecond {
+			t.Fatalf("Expected to wait about 100ms, waited %s", d)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 1000); err == nil {
+		t.Fatal("Expected a wait to be interrupted by a cancelled context")
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	var l rateLimiter
+	r := strings.NewReader("data")
+	if throttled(context.Background(), r, &l) != io.Reader(r) {
+		t.Fatal("Expected an unlimited reader to be returned unchanged")
+	}
+
+	l.setRate(1 << 20)
+	tr := throttled(context.Background(), r, &l)
+	ra, ok := tr.(io.ReaderAt)
+	if !ok {
+		t.Fatal("Expected a throttled reader to keep io.ReaderAt")
+	}
+
+	data := bytes.Repeat([]byte("x"), 3*throttleChunk+1)
+	ra = throttled(context.Background(), bytes.NewReader(data), &l).(io.ReaderAt)
+	p := make([]byte, len(data)-1)
+	if n, err := ra.ReadAt(p, 1); err != nil || n != len(p) {
+		t.Fatalf("Expected to read %d bytes, got %d: %v", len(p), n, err)
+	}
+	if n, err := ra.ReadAt(p, 2); err != io.EOF || n != len(p)-1 {
+		t.Fatalf("Expected to read %d bytes up to EOF, got %d: %v", len(p)-1, n, err)
+	}
+}
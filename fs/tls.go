@@ -0,0 +1,138 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// tlsVersions maps the values of the tls_min_version option to their
+// versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// reloadTransport passes requests to the current transport, which is
+// replaced when the certificates are reloaded.
+type reloadTransport struct {
+	current atomic.Value
+}
+
+// RoundTrip - performs the request with the current transport.
+func (t *reloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current.Load().(*http.Transport).RoundTrip(req)
+}
+
+// store replaces the current transport, whose connections are closed once
+// idle.
+func (t *reloadTransport) store(transport *http.Transport) {
+	old, _ := t.current.Load().(*http.Transport)
+	t.current.Store(transport)
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// tlsConfig returns the TLS configuration of connections to the server,
+// with the certificates read from their files.
+func (mfs *MinFS) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: mfs.config.insecure,
+		MinVersion:         tlsVersions[mfs.config.tlsMinVersion],
+	}
+
+	if mfs.config.caCert != "" {
+		data, err := ioutil.ReadFile(mfs.config.caCert)
+		if err != nil {
+			return nil, err
+		}
+
+		// the bundle is trusted in addition to the system roots
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("No certificates found in " + mfs.config.caCert)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if mfs.config.cert != "" {
+		cert, err := tls.LoadX509KeyPair(mfs.config.cert, mfs.config.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// newTransport returns a transport of requests to the server.
+func (mfs *MinFS) newTransport() (*http.Transport, error) {
+	tlsConfig, err := mfs.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		// Set this value so that the underlying transport round-tripper
+		// doesn't try to auto decode the body of objects with
+		// content-encoding set to `gzip`.
+		//
+		// Refer:
+		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
+		DisableCompression: true,
+	}, nil
+}
+
+// reloadCerts rereads the certificates, which are used by new
+// connections.
+func (mfs *MinFS) reloadCerts() {
+	if mfs.config.caCert == "" && mfs.config.cert == "" {
+		return
+	}
+
+	transport, err := mfs.newTransport()
+	if err != nil {
+		mfs.log.Errorln("Unable to reload certificates.", err)
+		return
+	}
+
+	mfs.transport.store(transport)
+	mfs.log.Println("Reloaded certificates.")
+}
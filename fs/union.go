@@ -0,0 +1,291 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"golang.org/x/net/context"
+)
+
+// Union mounts map several sources onto subdirectories named after them,
+// or layer them with the first one as writable top layer. Remote paths
+// start with the name of the source, followed by the key of the object
+// including the base path of the source.
+
+// header carrying the layer of objects listed in layered union mounts.
+const layerHeader = "X-Minfs-Layer"
+
+// errCrossDevice is returned for renames between sources, or of
+// directories of layered union mounts.
+var errCrossDevice = fuse.Errno(syscall.EXDEV)
+
+// UnionConfig - sources of a union mount, read from a json file.
+type UnionConfig struct {
+	Version string        `json:"version"`
+	Layered bool          `json:"layered"`
+	Sources []UnionSource `json:"sources"`
+}
+
+// UnionSource - bucket and prefix of a union mount, on the endpoint of the
+// target url or the one of the mount. Credentials default to the ones of
+// `config.json`.
+type UnionSource struct {
+	Name        string `json:"name"`
+	Target      string `json:"target"`
+	AccessKey   string `json:"accessKey"`
+	SecretKey   string `json:"secretKey"`
+	SecretToken string `json:"secretToken"`
+
+	target   *url.URL
+	bucket   string
+	basePath string
+}
+
+// LoadUnionConfig - reads the union mount configuration file name.
+func LoadUnionConfig(name string) (*UnionConfig, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	union := &UnionConfig{}
+	if err = json.Unmarshal(data, union); err != nil {
+		return nil, err
+	}
+
+	for i := range union.Sources {
+		src := &union.Sources[i]
+		if src.target, err = url.Parse(src.Target); err != nil {
+			return nil, err
+		}
+		src.bucket, src.basePath = splitTarget(src.target)
+	}
+	return union, nil
+}
+
+// validate checks the sources for sane values.
+func (union *UnionConfig) validate() error {
+	if len(union.Sources) == 0 {
+		return errors.New("Union has no sources")
+	}
+
+	names := map[string]bool{}
+	for _, src := range union.Sources {
+		if src.Name == "" || src.Name == "." || src.Name == ".." || strings.Contains(src.Name, "/") {
+			return fmt.Errorf("Union source name %q is not valid", src.Name)
+		} else if names[src.Name] {
+			return fmt.Errorf("Union source %s is not unique", src.Name)
+		} else if src.bucket == "" {
+			return fmt.Errorf("Union source %s has no bucket", src.Name)
+		}
+		names[src.Name] = true
+	}
+	return nil
+}
+
+// isUnion returns true for union mounts.
+func (mfs *MinFS) isUnion() bool {
+	return mfs.config.union != nil
+}
+
+// layered returns true if the sources of a union mount are layered.
+func (mfs *MinFS) layered() bool {
+	return mfs.isUnion() && mfs.config.union.Layered
+}
+
+// source returns the union source name, nil if there is none.
+func (mfs *MinFS) source(name string) *UnionSource {
+	if !mfs.isUnion() {
+		return nil
+	}
+
+	for i := range mfs.config.union.Sources {
+		if src := &mfs.config.union.Sources[i]; src.Name == name {
+			return src
+		}
+	}
+	return nil
+}
+
+// client returns the api client of the endpoint of remotePath.
+func (mfs *MinFS) client(remotePath string) *minio.Client {
+	root, _ := mfs.splitRoot(remotePath)
+	if api, ok := mfs.clients[root]; ok {
+		return api
+	}
+	return mfs.api
+}
+
+// isSources returns true if dir is the root directory with the sources of
+// a union mount.
+func (dir *Dir) isSources() bool {
+	return dir.dir == nil && dir.mfs.isUnion() && !dir.mfs.layered()
+}
+
+// unionPath returns the remote path of the path p within a union mount,
+// in the top layer if layered.
+func (mfs *MinFS) unionPath(p string) string {
+	if mfs.layered() {
+		src := mfs.config.union.Sources[0]
+		return mfs.joinPath(src.Name, path.Join(src.basePath, mfs.encodePath(p)))
+	}
+
+	// source names aren't encrypted
+	name, rel := mfs.splitRoot(p)
+	if src := mfs.source(name); src != nil {
+		return mfs.joinPath(name, path.Join(src.basePath, mfs.encodePath(rel)))
+	}
+	return mfs.joinPath(name, mfs.encodePath(rel))
+}
+
+// layerPath returns the remote path in layer of the remote path
+// remotePath of the top layer.
+func (mfs *MinFS) layerPath(remotePath string, layer int) string {
+	if layer == 0 {
+		return remotePath
+	}
+
+	sources := mfs.config.union.Sources
+	_, key := mfs.splitRoot(remotePath)
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, sources[0].basePath), "/")
+
+	src := sources[layer]
+	p := mfs.joinPath(src.Name, path.Join(src.basePath, rel))
+	if strings.HasSuffix(remotePath, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// unionMountPath returns the path within a union mount of the object
+// remotePath.
+func (mfs *MinFS) unionMountPath(remotePath string) string {
+	name, key := mfs.splitRoot(remotePath)
+	src := mfs.source(name)
+	if src == nil {
+		return remotePath
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, src.basePath), "/")
+	if decoded, ok := mfs.decodePath(rel); ok {
+		rel = decoded
+	}
+
+	if mfs.layered() {
+		return rel
+	}
+	return path.Join(name, rel)
+}
+
+// layerOf returns the layer objInfo has been listed from.
+func layerOf(objInfo minio.ObjectInfo) int {
+	layer, _ := strconv.Atoi(objInfo.Metadata.Get(layerHeader))
+	return layer
+}
+
+// listLayers calls fn for the objects directly below prefix of the top
+// layer in all layers, and for the prefixes of the others. Objects and
+// prefixes of upper layers hide the ones of the same name below them.
+func (mfs *MinFS) listLayers(ctx context.Context, prefix string, fn func(minio.ObjectInfo) error) error {
+	seen := map[string]bool{}
+	for layer := range mfs.config.union.Sources {
+		layerPrefix := mfs.layerPath(prefix, layer)
+		if err := mfs.listObjects(ctx, layerPrefix, false, func(objInfo minio.ObjectInfo) error {
+			objInfo.Key = prefix + objInfo.Key[len(layerPrefix):]
+
+			name := strings.TrimSuffix(objInfo.Key, "/")
+			if seen[name] {
+				return nil
+			}
+			seen[name] = true
+
+			objInfo.Metadata = http.Header{layerHeader: {strconv.Itoa(layer)}}
+			return fn(objInfo)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listSources calls fn for every source of the union mount, as a prefix.
+func (mfs *MinFS) listSources(ctx context.Context, fn func(minio.ObjectInfo) error) error {
+	for _, src := range mfs.config.union.Sources {
+		if err := fn(minio.ObjectInfo{Key: src.Name + "/"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// crossDevice returns true if the remote paths are in different sources,
+// or directories of a layered union mount are renamed.
+func (mfs *MinFS) crossDevice(dir, newDir *Dir, isDir bool) bool {
+	if isDir && mfs.layered() {
+		return true
+	}
+
+	root, _ := mfs.splitRoot(dir.RemotePath())
+	newRoot, _ := mfs.splitRoot(newDir.RemotePath())
+	return root != newRoot
+}
+
+// initSources creates the api clients of the sources, and checks that
+// their buckets exist.
+func (mfs *MinFS) initSources() error {
+	mfs.clients = map[string]*minio.Client{}
+	for _, src := range mfs.config.union.Sources {
+		ep := mfs.sourceEndpoint(&src)
+		creds := credentials.NewStaticV4(ep.access, ep.secret, ep.token)
+		api, err := minio.NewWithCredentials(ep.target.Host, creds, ep.target.Scheme == "https", "")
+		if err != nil {
+			return err
+		}
+
+		api.SetCustomTransport(mfs.transport)
+		mfs.clients[src.Name] = api
+
+		var exists bool
+		if err = mfs.s3(context.Background(), "BucketExists", src.Name, func() (berr error) {
+			exists, berr = api.BucketExists(src.bucket)
+			return berr
+		}); err == errOffline {
+			// serve from the cache until the server is reachable
+			continue
+		} else if err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("Bucket %s of source %s doesn't exist", src.bucket, src.Name)
+		}
+	}
+
+	mfs.log.Printf("Mounting union of %d sources.\n", len(mfs.config.union.Sources))
+	return nil
+}
@@ -0,0 +1,273 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/s3utils"
+	"golang.org/x/net/context"
+)
+
+const (
+	// uploads up to this size are sent with a single request, as the api
+	// client does.
+	maxSinglePutSize = 64 * 1024 * 1024
+
+	// maximum number of parts of a multipart upload.
+	maxPartsCount = 10000
+
+	// maximum size of an object copied with a single request, and of the
+	// parts of a composition.
+	maxCopySize = 5 * 1024 * 1024 * 1024
+)
+
+// initiateMultipartUploadResult is the response of a new multipart upload.
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// composeSource is a source of a server side composition, which is only
+// read while its etag matches, if set.
+type composeSource struct {
+	path string
+	size int64
+	etag string
+}
+
+// putObject uploads length bytes of r to remotePath. The api client would
+// store headers as user metadata, so uploads with headers are sent as
+// signed requests.
+func (mfs *MinFS) putObject(ctx context.Context, remotePath string, r io.Reader, length int64, contentType string, headers map[string]string) (int64, error) {
+	bucket, key := mfs.splitPath(remotePath)
+	if len(headers) == 0 {
+		return mfs.client(remotePath).PutObject(bucket, key, r, length, &minio.PutObjectOptions{
+			ContentType: contentType,
+		})
+	}
+
+	header := http.Header{}
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	if length > maxSinglePutSize {
+		return mfs.putObjectParts(ctx, remotePath, r, length, header)
+	}
+
+	req, err := mfs.newRequest(ctx, "PUT", remotePath, nil, r, length, nil, header)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := mfs.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, responseError(resp)
+	}
+	return length, nil
+}
+
+// putObjectParts uploads length bytes of r to remotePath in parts, with the
+// headers set on the new upload.
+func (mfs *MinFS) putObjectParts(ctx context.Context, remotePath string, r io.Reader, length int64, header http.Header) (n int64, err error) {
+	uploadID, err := mfs.newMultipartUpload(ctx, remotePath, header)
+	if err != nil {
+		return 0, err
+	}
+
+	core := minio.Core{Client: mfs.client(remotePath)}
+	bucket, key := mfs.splitPath(remotePath)
+	defer func() {
+		if err != nil {
+			core.AbortMultipartUpload(bucket, key, uploadID)
+		}
+	}()
+
+	partSize := int64(maxSinglePutSize)
+	if length > partSize*maxPartsCount {
+		partSize = (length + maxPartsCount - 1) / maxPartsCount
+	}
+
+	// only customer provided keys are sent with every part
+	parts := []minio.CompletePart{}
+	for n < length {
+		size := partSize
+		if length-n < size {
+			size = length - n
+		}
+
+		part, perr := core.PutObjectPartWithMetadata(bucket, key, uploadID, len(parts)+1, io.LimitReader(r, size), size, nil, nil, mfs.sseCHeaders())
+		if perr != nil {
+			return n, perr
+		}
+		n += size
+		parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	return n, core.CompleteMultipartUpload(bucket, key, uploadID, parts)
+}
+
+// newMultipartUpload starts a multipart upload to remotePath with header,
+// and returns its id.
+func (mfs *MinFS) newMultipartUpload(ctx context.Context, remotePath string, header http.Header) (string, error) {
+	resp, err := mfs.request(ctx, "POST", remotePath, url.Values{"uploads": {""}}, nil, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+
+	result := initiateMultipartUploadResult{}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// copySourceHeaders adds the headers reading the object at source to
+// header.
+func (mfs *MinFS) copySourceHeaders(header http.Header, source string) {
+	bucket, key := mfs.splitPath(source)
+	header.Set("X-Amz-Copy-Source", s3utils.EncodePath(bucket+"/"+key))
+	for k, v := range mfs.sseCHeaders() {
+		header.Set("X-Amz-Copy-Source-"+strings.TrimPrefix(k, "X-Amz-"), v)
+	}
+}
+
+// copyRequest copies source to target with a single request, with header
+// set on the copy. The metadata of source is kept, unless header replaces
+// it.
+func (mfs *MinFS) copyRequest(ctx context.Context, source, target string, header http.Header) error {
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	mfs.copySourceHeaders(h, source)
+
+	resp, err := mfs.request(ctx, "PUT", target, nil, nil, h)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = copyResult(resp)
+	return err
+}
+
+// composeObject composes target of srcs server side, with header set on
+// the new object. Its metadata isn't copied from the sources.
+func (mfs *MinFS) composeObject(ctx context.Context, target string, header http.Header, srcs []composeSource) (err error) {
+	uploadID, err := mfs.newMultipartUpload(ctx, target, header)
+	if err != nil {
+		return err
+	}
+
+	core := minio.Core{Client: mfs.client(target)}
+	bucket, key := mfs.splitPath(target)
+	defer func() {
+		if err != nil {
+			core.AbortMultipartUpload(bucket, key, uploadID)
+		}
+	}()
+
+	parts := []minio.CompletePart{}
+	for _, src := range srcs {
+		// sources are split evenly, parts but the last one must not be
+		// smaller than 5MiB.
+		count := (src.size + maxCopySize - 1) / maxCopySize
+		for i := int64(0); i < count; i++ {
+			start, end := src.size*i/count, src.size*(i+1)/count
+			etag, perr := mfs.copyPart(ctx, target, uploadID, len(parts)+1, src, start, end)
+			if perr != nil {
+				return perr
+			}
+			parts = append(parts, minio.CompletePart{PartNumber: len(parts) + 1, ETag: etag})
+		}
+	}
+
+	return core.CompleteMultipartUpload(bucket, key, uploadID, parts)
+}
+
+// copyPart copies the bytes start to end of src as part partNumber of the
+// multipart upload to target, and returns its etag.
+func (mfs *MinFS) copyPart(ctx context.Context, target, uploadID string, partNumber int, src composeSource, start, end int64) (string, error) {
+	header := http.Header{}
+	for k, v := range mfs.sseCHeaders() {
+		header.Set(k, v)
+	}
+	mfs.copySourceHeaders(header, src.path)
+	header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if src.etag != "" {
+		header.Set("X-Amz-Copy-Source-If-Match", src.etag)
+	}
+
+	params := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	resp, err := mfs.request(ctx, "PUT", target, params, nil, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return copyResult(resp)
+}
+
+// copyResult returns the etag of the copy of resp. Copies may fail after
+// the status has been sent, with the error as body.
+func copyResult(resp *http.Response) (string, error) {
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	errResp := minio.ErrorResponse{}
+	if xml.Unmarshal(data, &errResp) == nil {
+		return "", errResp
+	}
+
+	result := struct {
+		ETag string
+	}{}
+	if err = xml.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	return result.ETag, nil
+}
@@ -0,0 +1,226 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	minio "github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+func TestPutObjectHeaders(t *testing.T) {
+	var (
+		header http.Header
+		body   string
+	)
+	mfs, cleanup := newTestFS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer cleanup()
+
+	n, err := mfs.putObject(context.Background(), "key", strings.NewReader("hello"), 5, "text/plain", map[string]string{
+		"X-Amz-Server-Side-Encryption": "aws:kms",
+		storageClassHeader:             "STANDARD_IA",
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 5 {
+		t.Errorf("Expected 5 bytes uploaded, got %d", n)
+	}
+
+	if header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" || header.Get(storageClassHeader) != "STANDARD_IA" {
+		t.Errorf("Expected the headers to be passed as is, got %v", header)
+	}
+	if header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected content type text/plain, got %q", header.Get("Content-Type"))
+	}
+	for k := range header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			t.Errorf("Expected no user metadata, got %s", k)
+		}
+	}
+
+	// the body is sent with chunk signatures over plain http
+	if !strings.Contains(body, "hello") || header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		t.Errorf("Expected a streamed body, got %q", body)
+	}
+}
+
+func TestNewMultipartUpload(t *testing.T) {
+	var (
+		query  string
+		header http.Header
+	)
+	mfs, cleanup := newTestFS(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, header = r.URL.RawQuery, r.Header
+		w.Write([]byte("<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>id</UploadId></InitiateMultipartUploadResult>"))
+	}))
+	defer cleanup()
+
+	uploadID, err := mfs.newMultipartUpload(context.Background(), "key", http.Header{
+		"X-Amz-Server-Side-Encryption": {"AES256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadID != "id" {
+		t.Errorf("Expected upload id, got %q", uploadID)
+	}
+	if query != "uploads=" || header.Get("X-Amz-Server-Side-Encryption") != "AES256" {
+		t.Errorf("Expected a new upload with the encryption header, got %s %v", query, header)
+	}
+}
+
+// objectHandler serves the object of a test bucket, and records the
+// headers of the requests changing it.
+func objectHandler(requests *[]*http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", "5242880")
+			w.Header().Set("ETag", "\"etag\"")
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			w.Header().Set("X-Amz-Meta-Owner", "someone")
+			w.Header().Set(storageClassHeader, "STANDARD_IA")
+			return
+		case r.Method == "POST" && r.URL.Query().Get("uploadId") != "":
+			w.Write([]byte("<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>object</Key><ETag>\"new\"</ETag></CompleteMultipartUploadResult>"))
+		case r.Method == "POST":
+			w.Write([]byte("<InitiateMultipartUploadResult><UploadId>id</UploadId></InitiateMultipartUploadResult>"))
+		case r.Method == "PUT" && r.URL.Query().Get("partNumber") != "":
+			w.Write([]byte("<CopyPartResult><ETag>\"part" + r.URL.Query().Get("partNumber") + "\"</ETag></CopyPartResult>"))
+		case r.Method == "PUT":
+			w.Write([]byte("<CopyObjectResult><ETag>\"copy\"</ETag></CopyObjectResult>"))
+		}
+		*requests = append(*requests, r)
+	})
+}
+
+func TestCopyObjectHeaders(t *testing.T) {
+	testCases := []struct {
+		mimeType    string
+		contentType string
+		directive   string
+		owner       string
+	}{
+		// the metadata is kept
+		{"", "", "", ""},
+		// changing the content type replaces the metadata
+		{"text/markdown", "text/markdown", "REPLACE", "someone"},
+		// the same content type keeps it
+		{"text/plain", "", "", ""},
+	}
+
+	for i, testCase := range testCases {
+		requests := []*http.Request{}
+		mfs, cleanup := newTestFS(t, objectHandler(&requests))
+		if testCase.mimeType != "" {
+			MimeType("*.md", testCase.mimeType)(mfs.config)
+		}
+
+		if err := mfs.copyObject("a.md", "b.md"); err != nil {
+			t.Fatalf("Test %d: %s", i+1, err)
+		}
+		cleanup()
+
+		if len(requests) != 1 {
+			t.Fatalf("Test %d: Expected a single copy, got %d requests", i+1, len(requests))
+		}
+		header := requests[0].Header
+		if header.Get("X-Amz-Copy-Source") != "bucket/a.md" {
+			t.Errorf("Test %d: Expected copy of bucket/a.md, got %q", i+1, header.Get("X-Amz-Copy-Source"))
+		}
+		if header.Get("Content-Type") != testCase.contentType || header.Get("X-Amz-Metadata-Directive") != testCase.directive {
+			t.Errorf("Test %d: Expected content type %q with directive %q, got %v", i+1, testCase.contentType, testCase.directive, header)
+		}
+		if header.Get(storageClassHeader) != "STANDARD_IA" {
+			t.Errorf("Test %d: Expected the storage class of the source, got %q", i+1, header.Get(storageClassHeader))
+		}
+		if header.Get("X-Amz-Meta-Owner") != testCase.owner {
+			t.Errorf("Test %d: Expected owner %q, got %q", i+1, testCase.owner, header.Get("X-Amz-Meta-Owner"))
+		}
+	}
+}
+
+func TestComposeObject(t *testing.T) {
+	requests := []*http.Request{}
+	mfs, cleanup := newTestFS(t, objectHandler(&requests))
+	defer cleanup()
+
+	header := http.Header{"Content-Type": {"text/plain"}}
+	srcs := []composeSource{
+		{path: "object", size: 3 * maxCopySize / 2, etag: "etag"},
+		{path: "part", size: 10},
+	}
+	if err := mfs.composeObject(context.Background(), "object", header, srcs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 5 {
+		t.Fatalf("Expected 5 requests, got %d", len(requests))
+	}
+	if requests[0].Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the content type on the new upload, got %v", requests[0].Header)
+	}
+
+	// the object is split into two parts of the same size
+	expected := []struct {
+		source, copyRange, etag string
+	}{
+		{"bucket/object", "bytes=0-4026531839", "etag"},
+		{"bucket/object", "bytes=4026531840-8053063679", "etag"},
+		{"bucket/part", "bytes=0-9", ""},
+	}
+	for i, part := range expected {
+		h := requests[i+1].Header
+		if h.Get("X-Amz-Copy-Source") != part.source || h.Get("X-Amz-Copy-Source-Range") != part.copyRange || h.Get("X-Amz-Copy-Source-If-Match") != part.etag {
+			t.Errorf("Part %d: Expected %v, got %v", i+1, part, h)
+		}
+	}
+}
+
+func TestCopyResult(t *testing.T) {
+	testCases := []struct {
+		body string
+		etag string
+		code string
+	}{
+		{"<CopyObjectResult><ETag>\"etag\"</ETag></CopyObjectResult>", "\"etag\"", ""},
+		{"<Error><Code>InternalError</Code></Error>", "", "InternalError"},
+	}
+
+	for i, testCase := range testCases {
+		etag, err := copyResult(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(testCase.body)),
+		})
+		if etag != testCase.etag {
+			t.Errorf("Test %d: Expected etag %q, got %q", i+1, testCase.etag, etag)
+		}
+		if code := minio.ToErrorResponse(err).Code; code != testCase.code {
+			t.Errorf("Test %d: Expected error %q, got %v", i+1, testCase.code, err)
+		}
+	}
+}
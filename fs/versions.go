@@ -0,0 +1,436 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// name of the virtual directory with the versions of the files of a
+// directory.
+const versionsDirName = ".versions"
+
+// format of the names of versions.
+const versionTimeFormat = "20060102T150405Z"
+
+// objectVersion is a version of an object or a delete marker, as listed
+// by ListObjectVersions.
+type objectVersion struct {
+	Key          string
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool
+	LastModified time.Time
+	ETag         string
+	Size         int64
+
+	DeleteMarker bool `xml:"-"`
+	Prefix       bool `xml:"-"`
+}
+
+// listVersionsResult is the response of ListObjectVersions.
+type listVersionsResult struct {
+	IsTruncated         bool
+	NextKeyMarker       string
+	NextVersionIDMarker string          `xml:"NextVersionIdMarker"`
+	Versions            []objectVersion `xml:"Version"`
+	DeleteMarkers       []objectVersion `xml:"DeleteMarker"`
+	CommonPrefixes      []struct {
+		Prefix string
+	}
+}
+
+// listVersions calls fn for all versions and delete markers of the
+// objects below prefix. Unless recursive, only the objects directly below
+// prefix are listed, and the common prefixes of the others are passed as
+// versions marked as prefix.
+func (mfs *MinFS) listVersions(ctx context.Context, prefix string, recursive bool, fn func(objectVersion) error) error {
+	root, keyPrefix := mfs.splitRoot(prefix)
+	params := url.Values{
+		"versions": {""},
+		"prefix":   {keyPrefix},
+	}
+	if !recursive {
+		params.Set("delimiter", "/")
+	}
+
+	for {
+		var result listVersionsResult
+		if err := mfs.s3(ctx, "ListObjectVersions", prefix, func() error {
+			resp, err := mfs.request(ctx, "GET", mfs.joinPath(root, ""), params, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return responseError(resp)
+			}
+
+			result = listVersionsResult{}
+			return xml.NewDecoder(resp.Body).Decode(&result)
+		}); err != nil {
+			return err
+		}
+
+		for _, version := range result.Versions {
+			version.Key = mfs.joinPath(root, version.Key)
+			version.ETag = strings.Trim(version.ETag, "\"")
+			if err := fn(version); err != nil {
+				return err
+			}
+		}
+
+		for _, marker := range result.DeleteMarkers {
+			marker.Key = mfs.joinPath(root, marker.Key)
+			marker.DeleteMarker = true
+			if err := fn(marker); err != nil {
+				return err
+			}
+		}
+
+		for _, prefix := range result.CommonPrefixes {
+			if err := fn(objectVersion{Key: mfs.joinPath(root, prefix.Prefix), Prefix: true}); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+
+		params.Set("key-marker", result.NextKeyMarker)
+		params.Set("version-id-marker", result.NextVersionIDMarker)
+	}
+}
+
+// getVersion returns the content of the given version of the object at
+// remotePath.
+func (mfs *MinFS) getVersion(ctx context.Context, remotePath, versionID string) (io.ReadCloser, error) {
+	header := http.Header{}
+	for k, v := range mfs.sseCHeaders() {
+		header.Set(k, v)
+	}
+
+	resp, err := mfs.request(ctx, "GET", remotePath, url.Values{"versionId": {versionID}}, nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// versionsDir is the read-only directory with the versions of the files
+// of dir, by file name.
+type versionsDir struct {
+	dir *Dir
+}
+
+// Attr returns the attributes of the directory.
+func (vd *versionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Mode: os.ModeDir | 0555,
+		Uid:  vd.dir.mfs.config.uid,
+		Gid:  vd.dir.mfs.config.gid,
+	}
+	return nil
+}
+
+// prefix returns the object prefix of the files of the directory.
+func (vd *versionsDir) prefix() string {
+	prefix := vd.dir.RemotePath()
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+	return prefix
+}
+
+// ReadDirAll lists the files with versions.
+func (vd *versionsDir) ReadDirAll(ctx context.Context) (entries []fuse.Dirent, err error) {
+	t := vd.dir.mfs.trace(subsystemFuse, "readdir", path.Join(vd.dir.FullPath(), versionsDirName))
+	defer t.done(&err)
+
+	names := map[string]bool{}
+	if err := vd.dir.mfs.listVersions(ctx, vd.prefix(), false, func(version objectVersion) error {
+		if vd.dir.mfs.isInternal(version.Key) || version.DeleteMarker || version.Prefix {
+			return nil
+		}
+
+		if name, ok := vd.dir.mfs.decodeName(path.Base(version.Key)); ok {
+			names[name] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	entries = []fuse.Dirent{}
+	for name := range names {
+		entries = append(entries, fuse.Dirent{
+			Name: name,
+			Type: fuse.DT_Dir,
+		})
+	}
+	return entries, nil
+}
+
+// Lookup returns the versions of the file name.
+func (vd *versionsDir) Lookup(ctx context.Context, name string) (node fs.Node, err error) {
+	fvd := &fileVersionsDir{
+		mfs:        vd.dir.mfs,
+		remotePath: vd.prefix() + vd.dir.mfs.encodeName(name),
+		fullPath:   path.Join(vd.dir.FullPath(), versionsDirName, name),
+	}
+
+	versions, err := fvd.versions(ctx)
+	if err != nil {
+		return nil, err
+	} else if len(versions) == 0 {
+		return nil, fuse.ENOENT
+	}
+	return fvd, nil
+}
+
+// fileVersionsDir is the read-only directory with the versions of a file.
+// Versions are named by their modification time, and can be looked up by
+// version id as well.
+type fileVersionsDir struct {
+	mfs *MinFS
+
+	remotePath string
+	fullPath   string
+}
+
+// Attr returns the attributes of the directory.
+func (fvd *fileVersionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Mode: os.ModeDir | 0555,
+		Uid:  fvd.mfs.config.uid,
+		Gid:  fvd.mfs.config.gid,
+	}
+	return nil
+}
+
+// versions returns the versions of the file by name, newest first.
+func (fvd *fileVersionsDir) versions(ctx context.Context) ([]versionFile, error) {
+	versions := []versionFile{}
+	if err := fvd.mfs.listVersions(ctx, fvd.remotePath, false, func(version objectVersion) error {
+		if version.Key != fvd.remotePath || version.DeleteMarker {
+			return nil
+		}
+
+		versions = append(versions, versionFile{
+			mfs:        fvd.mfs,
+			remotePath: fvd.remotePath,
+			fullPath:   fvd.fullPath,
+			version:    version,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].version.LastModified.After(versions[j].version.LastModified)
+	})
+
+	// versions within the same second are told apart by their id
+	seen := map[string]bool{}
+	for i := range versions {
+		name := versions[i].version.LastModified.UTC().Format(versionTimeFormat)
+		if seen[name] {
+			name = name + "-" + versions[i].version.VersionID
+		}
+		seen[name] = true
+		versions[i].name = name
+	}
+	return versions, nil
+}
+
+// ReadDirAll lists the versions of the file.
+func (fvd *fileVersionsDir) ReadDirAll(ctx context.Context) (entries []fuse.Dirent, err error) {
+	t := fvd.mfs.trace(subsystemFuse, "readdir", fvd.fullPath)
+	defer t.done(&err)
+
+	versions, err := fvd.versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = []fuse.Dirent{}
+	for _, v := range versions {
+		entries = append(entries, fuse.Dirent{
+			Name: v.name,
+			Type: fuse.DT_File,
+		})
+	}
+	return entries, nil
+}
+
+// Lookup returns the version with the given name or version id.
+func (fvd *fileVersionsDir) Lookup(ctx context.Context, name string) (node fs.Node, err error) {
+	t := fvd.mfs.trace(subsystemFuse, "lookup", path.Join(fvd.fullPath, name))
+	defer t.done(&err)
+
+	versions, err := fvd.versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range versions {
+		if versions[i].name == name || versions[i].version.VersionID == name {
+			return &versions[i], nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// versionFile is a read-only version of a file.
+type versionFile struct {
+	mfs *MinFS
+
+	remotePath string
+	fullPath   string
+
+	name    string
+	version objectVersion
+}
+
+// Attr returns the attributes of the version.
+func (vf *versionFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Mode:   0444,
+		Size:   uint64(vf.mfs.plainSize(vf.version.Size)),
+		Atime:  vf.version.LastModified,
+		Mtime:  vf.version.LastModified,
+		Ctime:  vf.version.LastModified,
+		Crtime: vf.version.LastModified,
+		Uid:    vf.mfs.config.uid,
+		Gid:    vf.mfs.config.gid,
+	}
+	return nil
+}
+
+// Open fetches the version into a temporary cache file.
+func (vf *versionFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	t := vf.mfs.trace(subsystemFuse, "open", path.Join(vf.fullPath, vf.name))
+	defer t.done(&err)
+
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+
+	cachePath, err := vf.mfs.NewCachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	reserved := vf.mfs.plainSize(vf.version.Size)
+	if err = vf.mfs.reserveCache(reserved); err != nil {
+		return nil, err
+	}
+
+	// the version may be smaller than listed
+	var size int64
+	defer func() {
+		vf.mfs.releaseCache(reserved - size)
+	}()
+
+	file, err := os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if size, err = vf.fetch(ctx, file); err != nil {
+		file.Close()
+		vf.mfs.removeCacheFile(cachePath)
+		return nil, err
+	}
+
+	return &versionHandle{File: file, mfs: vf.mfs}, nil
+}
+
+// fetch writes the content of the version to file, and returns its size.
+func (vf *versionFile) fetch(ctx context.Context, file *os.File) (size int64, err error) {
+	err = vf.mfs.s3(ctx, "GetObject", vf.remotePath, func() error {
+		// start over after a failed attempt
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+
+		object, err := vf.mfs.getVersion(ctx, vf.remotePath, vf.version.VersionID)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		r := vf.mfs.downloadReader(ctx, object)
+		if vf.mfs.encrypted() {
+			if r, err = vf.mfs.newDecryptReader(r, vf.version.Size); err != nil {
+				return err
+			}
+		}
+
+		size, err = io.Copy(file, r)
+		vf.mfs.metrics.downloaded.Add(uint64(size))
+		return err
+	})
+	return size, err
+}
+
+// versionHandle is an open version, backed by a temporary cache file.
+type versionHandle struct {
+	*os.File
+
+	mfs *MinFS
+}
+
+// Read reads from the fetched version.
+func (vh *versionHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buff := make([]byte, req.Size)
+	n, err := vh.ReadAt(buff, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	resp.Data = buff[:n]
+	return nil
+}
+
+// Release removes the temporary cache file.
+func (vh *versionHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	vh.Close()
+	return vh.mfs.removeCacheFile(vh.Name())
+}
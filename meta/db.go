@@ -21,6 +21,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
 
@@ -46,7 +47,7 @@ func Open(path string, mode os.FileMode, options *bolt.Options) (*DB, error) {
 	}
 
 	return &DB{
-		db,
+		DB: db,
 	}, nil
 
 }
@@ -54,25 +55,37 @@ func Open(path string, mode os.FileMode, options *bolt.Options) (*DB, error) {
 // DB -
 type DB struct {
 	*bolt.DB
+
+	// OnTx is called with the duration of every finished transaction.
+	OnTx func(writable bool, duration time.Duration)
+}
+
+// observe calls OnTx if set.
+func (db *DB) observe(writable bool, start time.Time) {
+	if db.OnTx != nil {
+		db.OnTx(writable, time.Since(start))
+	}
 }
 
 // Begin -
 func (db *DB) Begin(writable bool) (*Tx, error) {
 	tx, err := db.DB.Begin(writable)
-	return &Tx{tx}, err
+	return &Tx{Tx: tx, db: db, start: time.Now()}, err
 }
 
 // Update -
 func (db *DB) Update(fn func(*Tx) error) error {
+	defer db.observe(true, time.Now())
 	return db.DB.Update(func(tx *bolt.Tx) error {
-		return fn(&Tx{tx})
+		return fn(&Tx{Tx: tx})
 	})
 }
 
 // View -
 func (db *DB) View(fn func(*Tx) error) error {
+	defer db.observe(false, time.Now())
 	return db.DB.View(func(tx *bolt.Tx) error {
-		return fn(&Tx{tx})
+		return fn(&Tx{Tx: tx})
 	})
 }
 
@@ -118,6 +131,32 @@ func (b *Bucket) CreateBucketIfNotExists(key string) (*Bucket, error) {
 // Tx - transaction struct.
 type Tx struct {
 	*bolt.Tx
+
+	// set for transactions started by Begin.
+	db    *DB
+	start time.Time
+	done  bool
+}
+
+// Commit -
+func (tx *Tx) Commit() error {
+	defer tx.finish()
+	return tx.Tx.Commit()
+}
+
+// Rollback -
+func (tx *Tx) Rollback() error {
+	defer tx.finish()
+	return tx.Tx.Rollback()
+}
+
+// finish reports the duration of a transaction started by Begin once.
+func (tx *Tx) finish() {
+	if tx.db == nil || tx.done {
+		return
+	}
+	tx.done = true
+	tx.db.observe(tx.Writable(), tx.start)
 }
 
 // Bucket -
@@ -25,6 +25,11 @@ import (
 )
 
 func main() {
+	if !minfs.NeedsDaemon(os.Args) {
+		minfs.Main()
+		return
+	}
+
 	dctx := &daemon.Context{
 		PidFileName: "/var/log/minfs.pid",
 		PidFilePerm: 0644,